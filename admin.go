@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Page sizes of GET /admin/coupons
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// CouponDetails is a coupon as the admin API returns it
+type CouponDetails struct {
+	CouponData
+	IsActive   bool `json:"is_active"`
+	Version    int  `json:"version"`
+	IsTemplate bool `json:"is_template"`
+	CampaignID *int `json:"campaign_id,omitempty"`
+}
+
+// CouponMedicinesRequest adds medicines to a coupon's medicine map
+type CouponMedicinesRequest struct {
+	MedicineIDs []string `json:"medicine_ids" validate:"required,min=1,dive,uuid"`
+}
+
+// CouponCategoriesRequest adds categories to a coupon's category map
+type CouponCategoriesRequest struct {
+	Categories []string `json:"categories" validate:"required,min=1,dive,required,max=100"`
+}
+
+// couponDetails wraps a loaded coupon for the admin API
+func couponDetails(coupon CouponData) CouponDetails {
+	return CouponDetails{
+		CouponData: coupon,
+		IsActive:   !coupon.inactive,
+		Version:    coupon.version,
+		IsTemplate: coupon.template,
+		CampaignID: coupon.campaignID,
+	}
+}
+
+// checkCouponData validates a coupon as addCoupons and the update receive it, returning nil when it is valid
+func checkCouponData(couponData CouponData) *Problem {
+	// an empty schedules list is the same as none, excluded_unless only accepts a nil slice
+	if len(couponData.Schedules) == 0 {
+		couponData.Schedules = nil
+	}
+	if err := validate.Struct(couponData); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+
+	// free_delivery waives the delivery charge, so it can't target the inventory alone
+	if couponData.DiscountType == "free_delivery" && couponData.DiscountTarget == "inventory" {
+		return validationProblem(map[string]string{
+			"DiscountTarget": "free_delivery coupons must target charges.",
+		})
+	}
+
+	// schedules are checked here so a bad start_time or end_time is a validation error
+	for _, schedule := range couponData.Schedules {
+		if _, _, err := schedule.minutes(); err != nil {
+			return validationProblem(map[string]string{
+				"Schedules": err.Error(),
+			})
+		}
+	}
+	return nil
+}
+
+// insertCouponRules stores the coupon's medicine and category maps, its exclusions and its schedules
+func insertCouponRules(ctx context.Context, q querier, couponData CouponData) error {
+	for _, medicineID := range couponData.ApplicableMedicineId {
+		if _, err := q.Exec(ctx, `INSERT INTO coupon_medicine_map(coupon_code, medicine_id) VALUES($1,$2)`,
+			couponData.CouponCode, medicineID); err != nil {
+			return err
+		}
+	}
+	for _, category := range couponData.ApplicableCategories {
+		if _, err := q.Exec(ctx, `INSERT INTO coupon_category_map(coupon_code, category_name) VALUES($1,$2)`,
+			couponData.CouponCode, category); err != nil {
+			return err
+		}
+	}
+	for _, medicineID := range couponData.ExcludedMedicineId {
+		if _, err := q.Exec(ctx, `INSERT INTO coupon_medicine_exclusion(coupon_code, medicine_id) VALUES($1,$2)`,
+			couponData.CouponCode, medicineID); err != nil {
+			return err
+		}
+	}
+	for _, category := range couponData.ExcludedCategories {
+		if _, err := q.Exec(ctx, `INSERT INTO coupon_category_exclusion(coupon_code, category_name) VALUES($1,$2)`,
+			couponData.CouponCode, category); err != nil {
+			return err
+		}
+	}
+	return insertCouponSchedules(ctx, q, couponData.CouponCode, couponData.Schedules)
+}
+
+// couponStatusFilters are the conditions of the status filter of GET /admin/coupons
+var couponStatusFilters = map[string]string{
+	"active": `c.is_active AND now() >= COALESCE(c.valid_from, 'epoch'::timestamp)
+		AND now() <= COALESCE(c.valid_until, c.expiry_date) AND now() <= c.expiry_date`,
+	"upcoming": `c.is_active AND now() < c.valid_from`,
+	"expired":  `(now() > COALESCE(c.valid_until, c.expiry_date) OR now() > c.expiry_date)`,
+	"inactive": `NOT c.is_active`,
+}
+
+// GetCoupon godoc
+// @Summary Get a coupon
+// @Description Returns the coupon with its medicine and category maps, schedules and whether it is active
+// @Tags Admin
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Success 200 {object} CouponDetails "Coupon"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code} [get]
+func getCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	coupon, err := loadCoupon(c.Context(), connPool, c.Params("code"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeCouponNotFound, "Coupon not found")
+	}
+	if err != nil {
+		fmt.Printf("Error fetching coupon: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon")
+	}
+	return c.JSON(couponDetails(coupon))
+}
+
+// ListCoupons godoc
+// @Summary List coupons
+// @Description Pages through the coupons in coupon code order with optional filters
+// @Tags Admin
+// @Produce json
+// @Param status query string false "active, upcoming, expired or inactive"
+// @Param category query string false "Coupons mapped to this category"
+// @Param usage_type query string false "one_time, multi_use or time_based"
+// @Param search query string false "Part of the coupon code"
+// @Param campaign_id query int false "Lists the codes of this campaign, with the template's terms and limits, instead of the other coupons"
+// @Param page query int false "Page number, from 1" default(1)
+// @Param page_size query int false "Coupons per page, at most 100" default(20)
+// @Success 200 {object} map[string]interface{} "Coupons with the total count"
+// @Failure 400 {object} Problem "Invalid filter"
+// @Security ApiKeyAuth
+// @Router /admin/coupons [get]
+func listCouponsHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	page := c.QueryInt("page", 1)
+	pageSize := c.QueryInt("page_size", defaultPageSize)
+	if page < 1 || pageSize < 1 || pageSize > maxPageSize {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput,
+			fmt.Sprintf("page must be at least 1 and page_size between 1 and %d", maxPageSize))
+	}
+
+	var conditions []string
+	var args []any
+	addCondition := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if status := c.Query("status"); status != "" {
+		condition, ok := couponStatusFilters[status]
+		if !ok {
+			return newProblem(fiber.StatusBadRequest, codeInvalidInput, "status must be active, upcoming, expired or inactive")
+		}
+		conditions = append(conditions, condition)
+	}
+	if category := c.Query("category"); category != "" {
+		addCondition(`EXISTS (SELECT 1 FROM coupon_category_map ccm
+			WHERE ccm.coupon_code = c.coupon_code AND ccm.category_name = $%d)`, category)
+	}
+	if usageType := c.Query("usage_type"); usageType != "" {
+		if usageType != usageOneTime && usageType != usageMultiUse && usageType != usageTimeBased {
+			return newProblem(fiber.StatusBadRequest, codeInvalidInput, "usage_type must be one_time, multi_use or time_based")
+		}
+		addCondition(`c.usage_type = $%d`, usageType)
+	}
+	if search := c.Query("search"); search != "" {
+		addCondition(`c.coupon_code ILIKE '%%' || $%d || '%%'`, search)
+	}
+	// Campaign codes run into the thousands, they are only listed for the campaign asked for
+	if campaignID := c.QueryInt("campaign_id"); campaignID > 0 {
+		addCondition(`c.campaign_id = $%d`, campaignID)
+	} else {
+		conditions = append(conditions, `c.campaign_id IS NULL`)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, pageSize, (page-1)*pageSize)
+	query := fmt.Sprintf(`SELECT %s, count(*) OVER ()
+		FROM coupon c
+		%s
+		ORDER BY c.coupon_code
+		LIMIT $%d OFFSET $%d`, couponColumns, where, len(args)-1, len(args))
+
+	ctx := c.Context()
+	rows, err := connPool.Query(ctx, query, args...)
+	if err != nil {
+		fmt.Printf("Error listing coupons: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to list coupons")
+	}
+	var coupons []CouponData
+	var total int
+	for rows.Next() {
+		var coupon CouponData
+		if err := scanCoupon(countedRow{rows, &total}, &coupon); err != nil {
+			rows.Close()
+			fmt.Printf("Error reading coupon: %v\n", err)
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to list coupons")
+		}
+		coupons = append(coupons, coupon)
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Printf("Error listing coupons: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to list coupons")
+	}
+
+	if err := loadCouponRules(ctx, connPool, coupons); err != nil {
+		fmt.Printf("Error fetching coupon maps: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to list coupons")
+	}
+
+	// Campaign codes are listed with the template's current terms, as validate and reserve see them,
+	// and the template's limits, which cap the campaign across its codes
+	var template *CouponDetails
+	if campaignID := c.QueryInt("campaign_id"); campaignID > 0 {
+		var templateCode string
+		err := connPool.QueryRow(ctx, `SELECT template_code FROM coupon_campaign WHERE campaign_id = $1`, campaignID).Scan(&templateCode)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			fmt.Printf("Error fetching campaign: %v\n", err)
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to list coupons")
+		}
+		if err == nil {
+			loaded, err := loadCoupon(ctx, connPool, templateCode)
+			if err != nil {
+				fmt.Printf("Error fetching campaign template: %v\n", err)
+				return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to list coupons")
+			}
+			for i := range coupons {
+				coupons[i] = campaignCoupon(loaded, coupons[i])
+			}
+			details := couponDetails(loaded)
+			template = &details
+		}
+	}
+
+	details := make([]CouponDetails, len(coupons))
+	for i, coupon := range coupons {
+		details[i] = couponDetails(coupon)
+	}
+	response := fiber.Map{
+		"coupons":   details,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	}
+	if template != nil {
+		response["template"] = template
+	}
+	return c.JSON(response)
+}
+
+// countedRow scans a coupon row that has the window count(*) appended after couponColumns
+type countedRow struct {
+	pgx.Rows
+	total *int
+}
+
+func (r countedRow) Scan(dest ...any) error {
+	return r.Rows.Scan(append(dest, r.total)...)
+}
+
+// setCouponActive flips is_active and responds with the coupon's new state
+func setCouponActive(c *fiber.Ctx, connPool *pgxpool.Pool, active bool) error {
+	action, message := versionReactivated, "Coupon reactivated"
+	if !active {
+		action, message = versionDeactivated, "Coupon deactivated"
+	}
+	err := changeCoupon(c, connPool, action, func(ctx context.Context, tx pgx.Tx, code string) error {
+		_, err := tx.Exec(ctx, `UPDATE coupon SET is_active = $2 WHERE coupon_code = $1`, code, active)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"coupon_code": c.Params("code"),
+		"is_active":   active,
+		"message":     message,
+	})
+}
+
+// DeactivateCoupon godoc
+// @Summary Deactivate a coupon
+// @Description Stops the coupon from being validated, listed as applicable or reserved. Reservations already held can still be committed
+// @Tags Admin
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Success 200 {object} map[string]interface{} "Coupon deactivated"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code}/deactivate [post]
+func deactivateCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	return setCouponActive(c, connPool, false)
+}
+
+// ReactivateCoupon godoc
+// @Summary Reactivate a coupon
+// @Description Makes a deactivated coupon usable again
+// @Tags Admin
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Success 200 {object} map[string]interface{} "Coupon reactivated"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code}/reactivate [post]
+func reactivateCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	return setCouponActive(c, connPool, true)
+}
+
+// DeleteCoupon godoc
+// @Summary Delete a coupon
+// @Description Deletes a coupon with its maps and schedules. A coupon that has been redeemed or is held by an order can't be deleted, deactivate it instead
+// @Tags Admin
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Success 200 {object} map[string]interface{} "Coupon deleted"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Failure 409 {object} Problem "Coupon has been used or campaign codes were generated from it"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code} [delete]
+func deleteCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	code := c.Params("code")
+	ctx := c.Context()
+	tx, err := connPool.Begin(ctx)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	// The coupon row is locked so a reservation can't be taken while the usage is checked
+	var redemptions int
+	var used bool
+	err = tx.QueryRow(ctx, `SELECT total_redemptions,
+		EXISTS (SELECT 1 FROM coupon_usage WHERE coupon_code = $1 AND usage > 0)
+		OR EXISTS (SELECT 1 FROM coupon_reservation WHERE coupon_code = $1
+			AND (status = 'committed' OR (status = 'reserved' AND expires_at > now())))
+		FROM coupon WHERE coupon_code = $1 FOR UPDATE`, code).Scan(&redemptions, &used)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeCouponNotFound, "Coupon not found")
+	}
+	if err != nil {
+		fmt.Printf("Error checking coupon usage: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to check coupon usage")
+	}
+	if redemptions > 0 || used {
+		return newProblem(fiber.StatusConflict, codeCouponInUse,
+			"Coupon has been redeemed or is held by an order, deactivate it instead")
+	}
+
+	// The history keeps the coupon as it was when it was deleted
+	before, err := couponSnapshot(ctx, tx, code)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon")
+	}
+	if err := recordCouponDeletion(ctx, tx, code, adminUser(c), before); err != nil {
+		return databaseProblem(err)
+	}
+
+	for _, query := range []string{
+		`DELETE FROM coupon_medicine_map WHERE coupon_code = $1`,
+		`DELETE FROM coupon_category_map WHERE coupon_code = $1`,
+		`DELETE FROM coupon_medicine_exclusion WHERE coupon_code = $1`,
+		`DELETE FROM coupon_category_exclusion WHERE coupon_code = $1`,
+		`DELETE FROM coupon_schedule WHERE coupon_code = $1`,
+		`DELETE FROM coupon_user_assignment WHERE coupon_code = $1`,
+		`DELETE FROM coupon_cohort_assignment WHERE coupon_code = $1`,
+		`DELETE FROM coupon_usage WHERE coupon_code = $1`,
+		`DELETE FROM coupon_reservation WHERE coupon_code = $1`,
+		`DELETE FROM coupon WHERE coupon_code = $1`,
+	} {
+		_, err := tx.Exec(ctx, query, code)
+		// Campaign codes generated from a template still reference it
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			return newProblem(fiber.StatusConflict, codeCouponInUse,
+				"Coupon is still referenced, by the codes of its campaign or its redemptions, deactivate it instead")
+		}
+		if err != nil {
+			return databaseProblem(err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
+	}
+	return c.JSON(fiber.Map{
+		"coupon_code": code,
+		"message":     "Coupon deleted",
+	})
+}
+
+// AddCouponMedicines godoc
+// @Summary Add medicines to a coupon
+// @Description Maps the medicines to the coupon, medicines already mapped are skipped
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Param request body CouponMedicinesRequest true "Medicines"
+// @Success 200 {object} CouponDetails "Coupon"
+// @Failure 400 {object} Problem "Validation errors or unknown medicine"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code}/medicines [post]
+func addCouponMedicinesHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	var req CouponMedicinesRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	return updateCouponMap(c, connPool, req, versionMedicinesAdded, `INSERT INTO coupon_medicine_map (coupon_code, medicine_id)
+		SELECT $1, unnest($2::uuid[]) ON CONFLICT DO NOTHING`, req.MedicineIDs)
+}
+
+// RemoveCouponMedicine godoc
+// @Summary Remove a medicine from a coupon
+// @Tags Admin
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Param medicine_id path string true "Medicine ID"
+// @Success 200 {object} CouponDetails "Coupon"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code}/medicines/{medicine_id} [delete]
+func removeCouponMedicineHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	return updateCouponMap(c, connPool, nil, versionMedicineRemoved, `DELETE FROM coupon_medicine_map
+		WHERE coupon_code = $1 AND medicine_id::text = $2`, c.Params("medicine_id"))
+}
+
+// AddCouponCategories godoc
+// @Summary Add categories to a coupon
+// @Description Maps the categories to the coupon, categories already mapped are skipped
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Param request body CouponCategoriesRequest true "Categories"
+// @Success 200 {object} CouponDetails "Coupon"
+// @Failure 400 {object} Problem "Validation errors"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code}/categories [post]
+func addCouponCategoriesHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	var req CouponCategoriesRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	return updateCouponMap(c, connPool, req, versionCategoriesAdded, `INSERT INTO coupon_category_map (coupon_code, category_name)
+		SELECT $1, unnest($2::text[]) ON CONFLICT DO NOTHING`, req.Categories)
+}
+
+// RemoveCouponCategory godoc
+// @Summary Remove a category from a coupon
+// @Tags Admin
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Param category path string true "Category name"
+// @Success 200 {object} CouponDetails "Coupon"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code}/categories/{category} [delete]
+func removeCouponCategoryHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	// Category names have spaces, such as "Pain Relief", so the path parameter arrives escaped
+	category, err := url.PathUnescape(c.Params("category"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid category")
+	}
+	return updateCouponMap(c, connPool, nil, versionCategoryRemoved, `DELETE FROM coupon_category_map
+		WHERE coupon_code = $1 AND category_name = $2`, category)
+}
+
+// updateCouponMap validates the request, when there is one, runs the map change for the coupon
+// of the path, records it in the history and responds with the updated coupon
+func updateCouponMap(c *fiber.Ctx, connPool *pgxpool.Pool, req any, action, query string, arg any) error {
+	if req != nil {
+		if err := validate.Struct(req); err != nil {
+			return validationProblem(validationErrors(err))
+		}
+	}
+
+	err := changeCoupon(c, connPool, action, func(ctx context.Context, tx pgx.Tx, code string) error {
+		if err := checkNotCampaignCode(ctx, tx, code); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, query, code, arg)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return getCouponHandler(c, connPool)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// BestCouponRequest is used in /coupon/best
+type BestCouponRequest struct {
+	UserID uuid.UUID `json:"user_id"`
+	OrderInput
+}
+
+// RankedCoupon is a coupon that passed every validate rule, ranked by what it saves
+type RankedCoupon struct {
+	Rank                    int     `json:"rank"`
+	CouponCode              string  `json:"coupon_code"`
+	Savings                 float64 `json:"savings"`
+	ItemsDiscount           float64 `json:"items_discount"`
+	ChargesDiscount         float64 `json:"charges_discount"`
+	CapApplied              bool    `json:"cap_applied"`
+	OrderValueAfterDiscount float64 `json:"order_value_after_discount"`
+	Explanation             string  `json:"explanation"`
+}
+
+// RejectedCoupon is a candidate coupon that failed the validate rules, with every rule it failed
+type RejectedCoupon struct {
+	CouponCode string            `json:"coupon_code"`
+	Reasons    []CouponRejection `json:"reasons"`
+}
+
+// candidateCouponCodes returns the active coupons mapped to any medicine in the cart or any category
+// of the cart's lineage, and the site-wide coupons. Exclusions are left to the evaluation of each coupon.
+func candidateCouponCodes(ctx context.Context, q querier, order OrderInput, userID uuid.UUID) ([]string, error) {
+	var medicines []uuid.UUID
+	for _, item := range order.CartItems {
+		medicines = append(medicines, item.ID)
+	}
+	lineage, err := cartCategoryLineage(ctx, q, order)
+	if err != nil {
+		return nil, err
+	}
+	categories := lineageCategories(lineage)
+
+	rows, _ := q.Query(ctx, `SELECT DISTINCT c.coupon_code
+	FROM coupon c
+	LEFT JOIN coupon_medicine_map cmm ON c.coupon_code = cmm.coupon_code
+	LEFT JOIN coupon_category_map ccm ON c.coupon_code = ccm.coupon_code
+	WHERE (cmm.medicine_id = ANY($1::uuid[]) OR ccm.category_name = ANY($2::text[]) OR `+siteWideCondition+`) AND c.is_active AND NOT c.is_template
+		AND `+availableToUser(3)+`
+	ORDER BY c.coupon_code`, medicines, categories, userID)
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// describeDiscount puts a coupon's discount into words for the ranking explanation
+func describeDiscount(coupon CouponData) string {
+	var target string
+	switch coupon.DiscountTarget {
+	case "inventory":
+		target = "items"
+	case "charges":
+		target = "charges"
+	case "inventory_and_charges":
+		target = "items and charges"
+	}
+
+	switch coupon.DiscountType {
+	case "percentage":
+		if coupon.MaxDiscountAmount > 0 {
+			return fmt.Sprintf("%g%% off %s up to ₹%g", coupon.DiscountValue, target, coupon.MaxDiscountAmount)
+		}
+		return fmt.Sprintf("%g%% off %s", coupon.DiscountValue, target)
+	case "flat":
+		return fmt.Sprintf("₹%g off %s", coupon.DiscountValue, target)
+	default:
+		return "Free delivery"
+	}
+}
+
+// BestCoupon godoc
+// @Summary Find the best coupon for a cart
+// @Description Evaluates every coupon mapped to the cart with the full validate rules for the user and ranks them by the actual savings
+// @Tags Coupons
+// @Accept json
+// @Produce json
+// @Param request body BestCouponRequest true "Cart and user"
+// @Success 200 {object} map[string]interface{} "Best coupon with the ranking"
+// @Failure 400 {object} Problem "Bad request"
+// @Router /coupon/best [post]
+func bestCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool, cache *ristretto.Cache) error {
+	var req BestCouponRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if req.UserID == uuid.Nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "user_id is required")
+	}
+	if err := validateCharges(req.Charges); err != nil {
+		return err
+	}
+
+	ctx := c.Context()
+	var pricing CartPricing
+	var err error
+	req.OrderInput, pricing, err = priceCart(ctx, connPool, cache, req.OrderInput)
+	if err != nil {
+		return pricingError(err)
+	}
+
+	codes, err := candidateCouponCodes(ctx, connPool, req.OrderInput, req.UserID)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupons")
+	}
+
+	ranked := []RankedCoupon{}
+	rejected := []RejectedCoupon{}
+	for _, code := range codes {
+		coupon, err := loadCoupon(ctx, connPool, code)
+		if err != nil {
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon")
+		}
+
+		evaluation, err := evaluateCoupon(ctx, connPool, coupon, ValidateCoupon{
+			UserID:     req.UserID,
+			CouponCode: code,
+			OrderInput: req.OrderInput,
+		})
+		if err != nil {
+			fmt.Printf("Error evaluating coupon %s: %v\n", code, err)
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to evaluate coupon")
+		}
+		if !evaluation.IsValid {
+			rejected = append(rejected, RejectedCoupon{CouponCode: code, Reasons: evaluation.Rejections})
+			continue
+		}
+
+		savings := evaluation.ItemsDiscount + evaluation.ChargesDiscount
+		ranked = append(ranked, RankedCoupon{
+			CouponCode:              code,
+			Savings:                 savings,
+			ItemsDiscount:           evaluation.ItemsDiscount,
+			ChargesDiscount:         evaluation.ChargesDiscount,
+			CapApplied:              evaluation.CapApplied,
+			OrderValueAfterDiscount: evaluation.OrderValueAfterDiscount(req.OrderInput),
+			Explanation:             fmt.Sprintf("%s saves ₹%.2f", describeDiscount(coupon), savings),
+		})
+	}
+
+	// Highest savings first, ties keep the coupon code order so the ranking is stable
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Savings > ranked[j].Savings
+	})
+	for i := range ranked {
+		ranked[i].Rank = i + 1
+		if i > 0 {
+			ranked[i].Explanation += fmt.Sprintf(", ₹%.2f less than %s", ranked[0].Savings-ranked[i].Savings, ranked[0].CouponCode)
+		}
+	}
+
+	var best *RankedCoupon
+	if len(ranked) > 0 {
+		best = &ranked[0]
+	}
+
+	return c.JSON(fiber.Map{
+		"best_coupon":    best,
+		"ranked_coupons": ranked,
+		"not_applicable": rejected,
+		"pricing":        pricing,
+	})
+}
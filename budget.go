@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// CouponBudget is a coupon's global redemption cap and monetary budget with what has been used.
+// Zero caps mean the coupon is unlimited.
+type CouponBudget struct {
+	CouponCode          string  `json:"coupon_code"`
+	UsageType           string  `json:"usage_type"`
+	MaxTotalRedemptions int     `json:"max_total_redemptions"`
+	TotalBudget         float64 `json:"total_budget"`
+	TotalRedemptions    int     `json:"total_redemptions"`
+	BudgetUsed          float64 `json:"budget_used"`
+	ReservedRedemptions int     `json:"reserved_redemptions"`
+	ReservedBudget      float64 `json:"reserved_budget"`
+}
+
+// RemainingRedemptions is how many more orders can redeem the coupon, nil when it is unlimited.
+// Active reservations count as used.
+func (b CouponBudget) RemainingRedemptions() *int {
+	limit := redemptionLimit(b.UsageType, b.MaxTotalRedemptions)
+	if limit <= 0 {
+		return nil
+	}
+	remaining := max(limit-b.TotalRedemptions-b.ReservedRedemptions, 0)
+	return &remaining
+}
+
+// RemainingBudget is how much discount the coupon can still give, nil when it is unlimited.
+// Active reservations count as spent.
+func (b CouponBudget) RemainingBudget() *float64 {
+	if b.TotalBudget <= 0 {
+		return nil
+	}
+	remaining := max(b.TotalBudget-b.BudgetUsed-b.ReservedBudget, 0)
+	return &remaining
+}
+
+// check returns why one more redemption giving the discount would break the coupon's global limits,
+// or nil when it fits
+func (b CouponBudget) check(discount float64) *CouponRejection {
+	if remaining := b.RemainingRedemptions(); remaining != nil && *remaining == 0 {
+		return &CouponRejection{Code: reasonRedemptionLimit, Message: "Coupon has reached its redemption limit"}
+	}
+	if remaining := b.RemainingBudget(); remaining != nil && discount > *remaining {
+		return &CouponRejection{Code: reasonBudgetExhausted, Message: "Coupon budget is exhausted"}
+	}
+	return nil
+}
+
+// loadCouponBudget reads the coupon's global limits with the redemptions held by active reservations.
+// The limits of a campaign template apply across its codes, their redemptions are counted on the
+// template and their reservations are held against it. A template's usage type applies to each code,
+// the campaign is only capped by max_total_redemptions.
+// pgx.ErrNoRows is returned when the coupon does not exist.
+func loadCouponBudget(ctx context.Context, q querier, couponCode string) (CouponBudget, error) {
+	budgets, err := loadCouponBudgets(ctx, q, []string{couponCode})
+	if err != nil {
+		return CouponBudget{}, err
+	}
+	budget, found := budgets[couponCode]
+	if !found {
+		return budget, pgx.ErrNoRows
+	}
+	return budget, nil
+}
+
+// loadCouponBudgets is loadCouponBudget for several coupons in one query, keyed by coupon code.
+// Coupons that don't exist are left out.
+func loadCouponBudgets(ctx context.Context, q querier, codes []string) (map[string]CouponBudget, error) {
+	rows, _ := q.Query(ctx, `SELECT
+		c.coupon_code,
+		CASE WHEN c.is_template THEN 'multi_use' ELSE c.usage_type::text END,
+		COALESCE(c.max_total_redemptions, 0),
+		COALESCE(c.total_budget, 0),
+		c.total_redemptions,
+		c.budget_used,
+		count(r.reservation_id),
+		COALESCE(sum(r.items_discount + r.charges_discount), 0)
+	FROM coupon c
+	LEFT JOIN coupon_reservation r ON r.status = 'reserved' AND r.expires_at > now() AND (r.coupon_code = c.coupon_code
+		OR (c.is_template AND r.coupon_code IN (SELECT k.coupon_code FROM coupon k
+			JOIN coupon_campaign cc ON cc.campaign_id = k.campaign_id WHERE cc.template_code = c.coupon_code)))
+	WHERE c.coupon_code = ANY($1)
+	GROUP BY c.coupon_code`, codes)
+	budgets := make(map[string]CouponBudget, len(codes))
+	var budget CouponBudget
+	_, err := pgx.ForEachRow(rows, []any{
+		&budget.CouponCode,
+		&budget.UsageType,
+		&budget.MaxTotalRedemptions,
+		&budget.TotalBudget,
+		&budget.TotalRedemptions,
+		&budget.BudgetUsed,
+		&budget.ReservedRedemptions,
+		&budget.ReservedBudget,
+	}, func() error {
+		budgets[budget.CouponCode] = budget
+		return nil
+	})
+	return budgets, err
+}
+
+// lockCouponBudgets locks the rows of the coupons that have a global limit, one_time coupons included,
+// in coupon code order so concurrent reservations can't both take the last redemption or the last
+// of the budget
+func lockCouponBudgets(ctx context.Context, tx pgx.Tx, codes []string) error {
+	_, err := tx.Exec(ctx, `SELECT 1 FROM coupon
+		WHERE coupon_code = ANY($1)
+		AND (usage_type = 'one_time' OR max_total_redemptions IS NOT NULL OR total_budget IS NOT NULL)
+		ORDER BY coupon_code
+		FOR UPDATE`, codes)
+	return err
+}
+
+// CouponBudget godoc
+// @Summary Get a coupon's global redemptions and budget
+// @Description Shows the coupon's redemption cap and budget, what has been redeemed, what active reservations hold and what remains
+// @Tags Admin
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Success 200 {object} map[string]interface{} "Budget"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code}/budget [get]
+func couponBudgetHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	budget, err := loadCouponBudget(c.Context(), connPool, c.Params("code"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeCouponNotFound, "Coupon not found")
+	}
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch budget")
+	}
+
+	return c.JSON(fiber.Map{
+		"budget":                budget,
+		"remaining_redemptions": budget.RemainingRedemptions(),
+		"remaining_budget":      budget.RemainingBudget(),
+	})
+}
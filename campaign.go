@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Campaign code patterns. The default alphabet leaves out 0, O, 1, I and L so codes read out
+// of an SMS can't be mistyped.
+const (
+	defaultCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+	defaultCodeLength   = 8
+)
+
+// minCodeSpace is how many times larger than the campaign the space of possible codes must be,
+// it keeps codes hard to guess and collisions rare
+const minCodeSpace = 1000
+
+// generationAttempts bounds how many times codes colliding with existing coupons are generated again
+const generationAttempts = 5
+
+// CodePattern is how the codes of a campaign are generated: the prefix followed by length characters
+// drawn from the alphabet
+type CodePattern struct {
+	Prefix   string `json:"prefix" validate:"omitempty,alphanum,max=20"`
+	Length   int    `json:"length" validate:"omitempty,min=4,max=30"`
+	Alphabet string `json:"alphabet" validate:"omitempty,alphanum,min=2,max=64"`
+}
+
+// CreateCampaignRequest is used in POST /admin/campaigns
+type CreateCampaignRequest struct {
+	Name         string `json:"name" validate:"required,max=255"`
+	TemplateCode string `json:"template_code" validate:"required"`
+	Count        int    `json:"count" validate:"required,min=1,max=100000"`
+	CodePattern
+}
+
+// GenerateCodesRequest is used in POST /admin/campaigns/{id}/codes
+type GenerateCodesRequest struct {
+	Count int `json:"count" validate:"required,min=1,max=100000"`
+}
+
+// Campaign is a batch of single-use codes sharing the terms of a template coupon
+type Campaign struct {
+	CampaignID    int       `json:"campaign_id"`
+	Name          string    `json:"name"`
+	TemplateCode  string    `json:"template_code"`
+	Prefix        string    `json:"prefix"`
+	CodeLength    int       `json:"code_length"`
+	Alphabet      string    `json:"alphabet"`
+	CreatedBy     string    `json:"created_by"`
+	CreatedAt     time.Time `json:"created_at"`
+	CodeCount     int       `json:"code_count"`
+	RedeemedCount int       `json:"redeemed_count"`
+}
+
+// withDefaults fills in the default length and alphabet
+func (p CodePattern) withDefaults() CodePattern {
+	if p.Length == 0 {
+		p.Length = defaultCodeLength
+	}
+	if p.Alphabet == "" {
+		p.Alphabet = defaultCodeAlphabet
+	}
+	return p
+}
+
+// check reports what makes the pattern unusable for a campaign of the given size, or nil
+func (p CodePattern) check(total int) map[string]string {
+	seen := make(map[rune]bool)
+	for _, char := range p.Alphabet {
+		if seen[char] {
+			return map[string]string{"Alphabet": "alphabet characters must be distinct."}
+		}
+		seen[char] = true
+	}
+	if math.Pow(float64(len(p.Alphabet)), float64(p.Length)) < float64(total)*minCodeSpace {
+		return map[string]string{"Length": "too few possible codes for the campaign, use a longer length or alphabet."}
+	}
+	return nil
+}
+
+// generate draws n distinct codes. Characters are picked uniformly with crypto/rand, bytes that
+// would bias the pick towards the start of the alphabet are dropped.
+func (p CodePattern) generate(n int) ([]string, error) {
+	alphabet := len(p.Alphabet)
+	limit := 256 - 256%alphabet
+	buf := make([]byte, p.Length*2)
+	codes := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+
+	var code strings.Builder
+	for len(codes) < n {
+		code.Reset()
+		code.WriteString(p.Prefix)
+		for code.Len() < len(p.Prefix)+p.Length {
+			if _, err := rand.Read(buf); err != nil {
+				return nil, err
+			}
+			for _, b := range buf {
+				if int(b) < limit && code.Len() < len(p.Prefix)+p.Length {
+					code.WriteByte(p.Alphabet[int(b)%alphabet])
+				}
+			}
+		}
+		if !seen[code.String()] {
+			seen[code.String()] = true
+			codes = append(codes, code.String())
+		}
+	}
+	return codes, nil
+}
+
+// insertCampaignCodes generates count codes for the campaign and bulk inserts them as coupons.
+// Codes are copied into a staging table first so the ones colliding with an existing coupon
+// can be skipped and drawn again.
+func insertCampaignCodes(ctx context.Context, tx pgx.Tx, campaign Campaign, count int) error {
+	pattern := CodePattern{Prefix: campaign.Prefix, Length: campaign.CodeLength, Alphabet: campaign.Alphabet}
+	if _, err := tx.Exec(ctx, `CREATE TEMP TABLE IF NOT EXISTS campaign_code_staging (coupon_code VARCHAR(100) PRIMARY KEY)
+		ON COMMIT DROP`); err != nil {
+		return err
+	}
+
+	inserted := 0
+	for attempt := 0; inserted < count; attempt++ {
+		if attempt == generationAttempts {
+			return fmt.Errorf("generated %d of %d codes, the rest collided with existing coupons", inserted, count)
+		}
+		codes, err := pattern.generate(count - inserted)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `TRUNCATE campaign_code_staging`); err != nil {
+			return err
+		}
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"campaign_code_staging"}, []string{"coupon_code"},
+			pgx.CopyFromSlice(len(codes), func(i int) ([]any, error) {
+				return []any{codes[i]}, nil
+			}))
+		if err != nil {
+			return err
+		}
+
+		// The copied columns only fill in the coupon row, a campaign code is evaluated with the
+		// template's current terms, see loadCampaignCoupon
+		tag, err := tx.Exec(ctx, `INSERT INTO coupon (coupon_code, expiry_date, usage_type, min_order_value, valid_from,
+			valid_until, discount_type, discount_value, discount_target, terms_and_conditions, max_usage_per_user, campaign_id)
+			SELECT s.coupon_code, t.expiry_date, 'one_time', t.min_order_value, t.valid_from,
+				t.valid_until, t.discount_type, t.discount_value, t.discount_target, t.terms_and_conditions, 1, $2
+			FROM campaign_code_staging s CROSS JOIN coupon t
+			WHERE t.coupon_code = $1
+			ON CONFLICT (coupon_code) DO NOTHING`, campaign.TemplateCode, campaign.CampaignID)
+		if err != nil {
+			return err
+		}
+		inserted += int(tag.RowsAffected())
+	}
+	return nil
+}
+
+// loadCampaignCoupon is a campaign code as the validate rules see it: the template's current terms,
+// maps and schedules under the code. Every code is single use and is inactive when either the code
+// or the template has been deactivated. The template's redemption cap, budget and per-user limit
+// are not the code's own, they are checked across all the template's codes, see templateCode.
+func loadCampaignCoupon(ctx context.Context, q querier, code CouponData) (CouponData, error) {
+	var templateCode string
+	err := q.QueryRow(ctx, `SELECT template_code FROM coupon_campaign WHERE campaign_id = $1`, *code.campaignID).Scan(&templateCode)
+	if err != nil {
+		return code, err
+	}
+	template, err := loadCoupon(ctx, q, templateCode)
+	if err != nil {
+		return code, err
+	}
+	return campaignCoupon(template, code), nil
+}
+
+// campaignCoupon puts the code of a campaign under the template's terms
+func campaignCoupon(template CouponData, code CouponData) CouponData {
+	coupon := template
+	coupon.templateCode = template.CouponCode
+	coupon.campaignUserLimit = userUsageLimit(template)
+	coupon.CouponCode = code.CouponCode
+	coupon.UsageType = usageOneTime
+	coupon.MaxUsagePerUser = 1
+	coupon.MaxTotalRedemptions = 0
+	coupon.TotalBudget = 0
+	coupon.inactive = coupon.inactive || code.inactive
+	coupon.template = false
+	coupon.campaignID = code.campaignID
+	return coupon
+}
+
+// campaignUserUsage returns how many codes of the template the user holds: redemptions committed,
+// counted on the template's usage row, plus reservations of its codes that have not yet expired
+func campaignUserUsage(ctx context.Context, q querier, userID uuid.UUID, templateCode string) (int, error) {
+	var usage int
+	err := q.QueryRow(ctx, `SELECT
+		COALESCE((SELECT usage FROM coupon_usage WHERE user_id = $1 AND coupon_code = $2), 0) +
+		(SELECT count(*) FROM coupon_reservation r
+			JOIN coupon k ON k.coupon_code = r.coupon_code
+			JOIN coupon_campaign cc ON cc.campaign_id = k.campaign_id
+			WHERE r.user_id = $1 AND cc.template_code = $2 AND r.status = 'reserved' AND r.expires_at > now())
+	`, userID, templateCode).Scan(&usage)
+	return usage, err
+}
+
+// campaignTemplateCode returns the template of a campaign code, empty for the other coupons
+func campaignTemplateCode(ctx context.Context, q querier, couponCode string) (string, error) {
+	var templateCode string
+	err := q.QueryRow(ctx, `SELECT COALESCE(cc.template_code, '') FROM coupon k
+		LEFT JOIN coupon_campaign cc ON cc.campaign_id = k.campaign_id
+		WHERE k.coupon_code = $1`, couponCode).Scan(&templateCode)
+	return templateCode, err
+}
+
+// campaignCodeProblem is returned when an admin tries to change the terms of a single campaign code
+func campaignCodeProblem() *Problem {
+	return newProblem(fiber.StatusBadRequest, codeInvalidInput,
+		"Campaign codes follow the terms of their template, update the template instead")
+}
+
+// checkNotCampaignCode returns campaignCodeProblem when the coupon is a campaign code
+func checkNotCampaignCode(ctx context.Context, q querier, couponCode string) error {
+	var campaignCode bool
+	if err := q.QueryRow(ctx, `SELECT campaign_id IS NOT NULL FROM coupon WHERE coupon_code = $1`, couponCode).Scan(&campaignCode); err != nil {
+		return err
+	}
+	if campaignCode {
+		return campaignCodeProblem()
+	}
+	return nil
+}
+
+// loadCampaign reads a campaign with how many codes it has and how many were redeemed.
+// pgx.ErrNoRows is returned when it does not exist.
+func loadCampaign(ctx context.Context, q querier, campaignID int) (Campaign, error) {
+	rows, _ := q.Query(ctx, `SELECT cc.campaign_id, cc.name, cc.template_code, cc.prefix, cc.code_length,
+		cc.alphabet, cc.created_by, cc.created_at,
+		(SELECT count(*) FROM coupon c WHERE c.campaign_id = cc.campaign_id),
+		(SELECT count(*) FROM coupon c WHERE c.campaign_id = cc.campaign_id AND c.total_redemptions > 0)
+		FROM coupon_campaign cc WHERE cc.campaign_id = $1`, campaignID)
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByPos[Campaign])
+}
+
+// campaignID parses the campaign ID of the path
+func campaignID(c *fiber.Ctx) (int, error) {
+	id, err := c.ParamsInt("id")
+	if err != nil || id < 1 {
+		return 0, newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid campaign id")
+	}
+	return id, nil
+}
+
+// CreateCampaign godoc
+// @Summary Create a campaign of single-use codes
+// @Description Turns the coupon into a campaign template and generates count unique single-use codes from the pattern. Codes are evaluated with the template's current terms, maps and schedules, the template itself can no longer be redeemed
+// @Tags Campaigns
+// @Accept json
+// @Produce json
+// @Param request body CreateCampaignRequest true "Campaign, template coupon and code pattern"
+// @Success 201 {object} Campaign "Campaign"
+// @Failure 400 {object} Problem "Validation errors"
+// @Failure 404 {object} Problem "Template coupon not found"
+// @Security ApiKeyAuth
+// @Router /admin/campaigns [post]
+func createCampaignHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	var req CreateCampaignRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+	pattern := req.CodePattern.withDefaults()
+	if fields := pattern.check(req.Count); fields != nil {
+		return validationProblem(fields)
+	}
+
+	ctx := c.Context()
+	tx, err := connPool.Begin(ctx)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	// The template is locked so it can't change while its codes are copied from it
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM coupon WHERE coupon_code = $1 FOR UPDATE`, req.TemplateCode); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to lock coupon")
+	}
+	before, err := couponSnapshot(ctx, tx, req.TemplateCode)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeCouponNotFound, "Template coupon not found")
+	}
+	if err != nil {
+		fmt.Printf("Error fetching coupon: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon")
+	}
+	if before["campaign_id"] != nil {
+		return validationProblem(map[string]string{"TemplateCode": "a campaign code can't be a template."})
+	}
+
+	campaign := Campaign{
+		Name:         req.Name,
+		TemplateCode: req.TemplateCode,
+		Prefix:       pattern.Prefix,
+		CodeLength:   pattern.Length,
+		Alphabet:     pattern.Alphabet,
+		CreatedBy:    adminUser(c),
+	}
+	err = tx.QueryRow(ctx, `INSERT INTO coupon_campaign (name, template_code, prefix, code_length, alphabet, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING campaign_id`,
+		campaign.Name, campaign.TemplateCode, campaign.Prefix, campaign.CodeLength, campaign.Alphabet, campaign.CreatedBy).Scan(&campaign.CampaignID)
+	if err != nil {
+		return databaseProblem(err)
+	}
+	if _, err := tx.Exec(ctx, `UPDATE coupon SET is_template = true WHERE coupon_code = $1`, req.TemplateCode); err != nil {
+		return databaseProblem(err)
+	}
+	if err := recordCouponVersion(ctx, tx, req.TemplateCode, versionCampaignCreated, campaign.CreatedBy, before); err != nil {
+		return databaseProblem(err)
+	}
+	if err := insertCampaignCodes(ctx, tx, campaign, req.Count); err != nil {
+		fmt.Printf("Error generating campaign codes: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to generate campaign codes")
+	}
+
+	campaign, err = loadCampaign(ctx, tx, campaign.CampaignID)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch campaign")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
+	}
+	return c.Status(fiber.StatusCreated).JSON(campaign)
+}
+
+// GetCampaign godoc
+// @Summary Get a campaign
+// @Tags Campaigns
+// @Produce json
+// @Param id path int true "Campaign ID"
+// @Success 200 {object} Campaign "Campaign"
+// @Failure 404 {object} Problem "Campaign not found"
+// @Security ApiKeyAuth
+// @Router /admin/campaigns/{id} [get]
+func getCampaignHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	id, err := campaignID(c)
+	if err != nil {
+		return err
+	}
+	campaign, err := loadCampaign(c.Context(), connPool, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeNotFound, "Campaign not found")
+	}
+	if err != nil {
+		fmt.Printf("Error fetching campaign: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch campaign")
+	}
+	return c.JSON(campaign)
+}
+
+// GenerateCampaignCodes godoc
+// @Summary Generate more codes for a campaign
+// @Description Adds count codes drawn from the campaign's pattern
+// @Tags Campaigns
+// @Accept json
+// @Produce json
+// @Param id path int true "Campaign ID"
+// @Param request body GenerateCodesRequest true "How many codes"
+// @Success 200 {object} Campaign "Campaign"
+// @Failure 400 {object} Problem "Validation errors"
+// @Failure 404 {object} Problem "Campaign not found"
+// @Security ApiKeyAuth
+// @Router /admin/campaigns/{id}/codes [post]
+func generateCampaignCodesHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	id, err := campaignID(c)
+	if err != nil {
+		return err
+	}
+	var req GenerateCodesRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+
+	ctx := c.Context()
+	tx, err := connPool.Begin(ctx)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM coupon_campaign WHERE campaign_id = $1 FOR UPDATE`, id); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to lock campaign")
+	}
+	campaign, err := loadCampaign(ctx, tx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeNotFound, "Campaign not found")
+	}
+	if err != nil {
+		fmt.Printf("Error fetching campaign: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch campaign")
+	}
+	pattern := CodePattern{Prefix: campaign.Prefix, Length: campaign.CodeLength, Alphabet: campaign.Alphabet}
+	if pattern.check(campaign.CodeCount+req.Count) != nil {
+		return validationProblem(map[string]string{"Count": "the campaign's pattern has too few possible codes left."})
+	}
+
+	if err := insertCampaignCodes(ctx, tx, campaign, req.Count); err != nil {
+		fmt.Printf("Error generating campaign codes: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to generate campaign codes")
+	}
+	campaign, err = loadCampaign(ctx, tx, id)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch campaign")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
+	}
+	return c.JSON(campaign)
+}
+
+// ExportCampaignCodes godoc
+// @Summary Export the codes of a campaign
+// @Description Streams every code of the campaign as CSV with whether it is active and redeemed, for the SMS provider. The codes are sent in chunks as they are read, a failure part way cuts the CSV short
+// @Tags Campaigns
+// @Produce text/csv
+// @Param id path int true "Campaign ID"
+// @Success 200 {string} string "coupon_code,is_active,redeemed"
+// @Failure 404 {object} Problem "Campaign not found"
+// @Security ApiKeyAuth
+// @Router /admin/campaigns/{id}/export [get]
+func exportCampaignCodesHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	id, err := campaignID(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Context()
+	var exists bool
+	if err := connPool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM coupon_campaign WHERE campaign_id = $1)`, id).Scan(&exists); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch campaign")
+	}
+	if !exists {
+		return newProblem(fiber.StatusNotFound, codeNotFound, "Campaign not found")
+	}
+
+	c.Set(fiber.HeaderContentType, "text/csv")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="campaign-%d.csv"`, id))
+
+	// The rows are written as they are read from the query and sent in chunks, so a large campaign
+	// is never held in memory. The response has started by then, an error can only cut the CSV short.
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		rows, _ := connPool.Query(context.Background(), `SELECT coupon_code, is_active, total_redemptions > 0
+			FROM coupon WHERE campaign_id = $1 ORDER BY coupon_code`, id)
+		out := csv.NewWriter(w)
+		out.Write([]string{"coupon_code", "is_active", "redeemed"})
+		var code string
+		var active, redeemed bool
+		_, err := pgx.ForEachRow(rows, []any{&code, &active, &redeemed}, func() error {
+			return out.Write([]string{code, strconv.FormatBool(active), strconv.FormatBool(redeemed)})
+		})
+		out.Flush()
+		if err == nil {
+			err = out.Error()
+		}
+		if err != nil {
+			fmt.Printf("Error exporting campaign codes: %v\n", err)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// CategoryNode is a category with its subcategories
+type CategoryNode struct {
+	Name     string         `json:"name"`
+	Parent   *string        `json:"parent"`
+	Children []CategoryNode `json:"children"`
+}
+
+// CreateCategoryRequest is used in POST /admin/categories
+type CreateCategoryRequest struct {
+	Name   string  `json:"name" validate:"required,max=100"`
+	Parent *string `json:"parent" validate:"omitempty,max=100"`
+}
+
+// MoveCategoryRequest is used in PATCH /admin/categories/{name}, a null parent makes the category a root
+type MoveCategoryRequest struct {
+	Parent *string `json:"parent" validate:"omitempty,max=100"`
+}
+
+// categoryLineage maps every category to itself and all its ancestors in the category tree.
+// A coupon targeting a category covers the medicines of its subcategories, so a cart category
+// matches a coupon category found in its lineage. Categories missing from the tree only match themselves.
+func categoryLineage(ctx context.Context, q querier, categories []string) (map[string][]string, error) {
+	lineage := make(map[string][]string)
+	var category, ancestor string
+	rows, _ := q.Query(ctx, `WITH RECURSIVE lineage (category, ancestor) AS (
+			SELECT DISTINCT name, name FROM unnest($1::text[]) AS name
+			UNION
+			SELECT l.category, cat.parent_name::text
+			FROM lineage l
+			JOIN category cat ON cat.name = l.ancestor
+			WHERE cat.parent_name IS NOT NULL
+		)
+		SELECT category, ancestor FROM lineage`, categories)
+	_, err := pgx.ForEachRow(rows, []any{&category, &ancestor}, func() error {
+		lineage[category] = append(lineage[category], ancestor)
+		return nil
+	})
+	return lineage, err
+}
+
+// cartCategoryLineage is the lineage of every category of the cart's items
+func cartCategoryLineage(ctx context.Context, q querier, order OrderInput) (map[string][]string, error) {
+	categories := make([]string, len(order.CartItems))
+	for i, item := range order.CartItems {
+		categories[i] = item.Category
+	}
+	return categoryLineage(ctx, q, categories)
+}
+
+// lineageCategories flattens a lineage into every category and ancestor it holds
+func lineageCategories(lineage map[string][]string) []string {
+	var all []string
+	for _, ancestors := range lineage {
+		all = append(all, ancestors...)
+	}
+	return all
+}
+
+// buildCategoryTree nests the categories under their parents, starting from the given roots
+func buildCategoryTree(roots []string, parents map[string]*string, children map[string][]string) []CategoryNode {
+	nodes := make([]CategoryNode, len(roots))
+	for i, name := range roots {
+		nodes[i] = CategoryNode{
+			Name:     name,
+			Parent:   parents[name],
+			Children: buildCategoryTree(children[name], parents, children),
+		}
+	}
+	return nodes
+}
+
+// loadCategoryTree returns the subtree of the category, or the whole tree when root is empty.
+// pgx.ErrNoRows is returned when the category does not exist.
+func loadCategoryTree(ctx context.Context, q querier, root string) ([]CategoryNode, error) {
+	rows, _ := q.Query(ctx, `WITH RECURSIVE subtree AS (
+			SELECT name, parent_name FROM category WHERE ($1 = '' AND parent_name IS NULL) OR name = $1
+			UNION
+			SELECT cat.name, cat.parent_name FROM category cat JOIN subtree s ON cat.parent_name = s.name
+		)
+		SELECT name, parent_name FROM subtree ORDER BY name`, root)
+
+	var roots []string
+	parents := make(map[string]*string)
+	children := make(map[string][]string)
+	var name string
+	var parent *string
+	_, err := pgx.ForEachRow(rows, []any{&name, &parent}, func() error {
+		parents[name] = parent
+		if name == root || (root == "" && parent == nil) {
+			roots = append(roots, name)
+		} else {
+			children[*parent] = append(children[*parent], name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if root != "" && len(roots) == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	return buildCategoryTree(roots, parents, children), nil
+}
+
+// categoryName unescapes the category name of the path, names such as "Pain Relief" have spaces
+func categoryName(c *fiber.Ctx) (string, error) {
+	name, err := url.PathUnescape(c.Params("name"))
+	if err != nil {
+		return "", newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid category")
+	}
+	return name, nil
+}
+
+// ListCategories godoc
+// @Summary Get the category tree
+// @Tags Categories
+// @Produce json
+// @Success 200 {array} CategoryNode "Root categories with their subcategories"
+// @Security ApiKeyAuth
+// @Router /admin/categories [get]
+func listCategoriesHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	tree, err := loadCategoryTree(c.Context(), connPool, "")
+	if err != nil {
+		fmt.Printf("Error fetching categories: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch categories")
+	}
+	if tree == nil {
+		tree = []CategoryNode{}
+	}
+	return c.JSON(tree)
+}
+
+// GetCategory godoc
+// @Summary Get a category with its subcategories
+// @Tags Categories
+// @Produce json
+// @Param name path string true "Category name"
+// @Success 200 {object} CategoryNode "Category"
+// @Failure 404 {object} Problem "Category not found"
+// @Security ApiKeyAuth
+// @Router /admin/categories/{name} [get]
+func getCategoryHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	name, err := categoryName(c)
+	if err != nil {
+		return err
+	}
+	tree, err := loadCategoryTree(c.Context(), connPool, name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeNotFound, "Category not found")
+	}
+	if err != nil {
+		fmt.Printf("Error fetching category: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch category")
+	}
+	return c.JSON(tree[0])
+}
+
+// CreateCategory godoc
+// @Summary Add a category to the tree
+// @Description Adds a root category, or a subcategory when parent is set. Coupons targeting the parent cover the new category's medicines
+// @Tags Categories
+// @Accept json
+// @Produce json
+// @Param request body CreateCategoryRequest true "Category"
+// @Success 201 {object} CategoryNode "Category"
+// @Failure 400 {object} Problem "Validation errors or unknown parent"
+// @Failure 409 {object} Problem "Category already exists"
+// @Security ApiKeyAuth
+// @Router /admin/categories [post]
+func createCategoryHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	var req CreateCategoryRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+
+	_, err := connPool.Exec(c.Context(), `INSERT INTO category (name, parent_name) VALUES ($1, $2)`, req.Name, req.Parent)
+	if err != nil {
+		return databaseProblem(err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(CategoryNode{Name: req.Name, Parent: req.Parent, Children: []CategoryNode{}})
+}
+
+// MoveCategory godoc
+// @Summary Move a category in the tree
+// @Description Moves the category, with its subcategories, under another parent. A null parent makes it a root category. A category can't be moved under itself or one of its subcategories
+// @Tags Categories
+// @Accept json
+// @Produce json
+// @Param name path string true "Category name"
+// @Param request body MoveCategoryRequest true "New parent"
+// @Success 200 {object} CategoryNode "Category"
+// @Failure 400 {object} Problem "Validation errors or unknown parent"
+// @Failure 404 {object} Problem "Category not found"
+// @Security ApiKeyAuth
+// @Router /admin/categories/{name} [patch]
+func moveCategoryHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	name, err := categoryName(c)
+	if err != nil {
+		return err
+	}
+	var req MoveCategoryRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+
+	ctx := c.Context()
+	tx, err := connPool.Begin(ctx)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	// Moves are serialized so two of them can't close a cycle between them
+	if _, err := tx.Exec(ctx, `LOCK TABLE category IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to lock categories")
+	}
+
+	if req.Parent != nil {
+		lineage, err := categoryLineage(ctx, tx, []string{*req.Parent})
+		if err != nil {
+			fmt.Printf("Error fetching category lineage: %v\n", err)
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch categories")
+		}
+		for _, ancestor := range lineage[*req.Parent] {
+			if ancestor == name {
+				return validationProblem(map[string]string{"Parent": "a category can't be moved under itself or one of its subcategories."})
+			}
+		}
+	}
+
+	tag, err := tx.Exec(ctx, `UPDATE category SET parent_name = $2 WHERE name = $1`, name, req.Parent)
+	if err != nil {
+		return databaseProblem(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return newProblem(fiber.StatusNotFound, codeNotFound, "Category not found")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
+	}
+
+	return getCategoryHandler(c, connPool)
+}
+
+// DeleteCategory godoc
+// @Summary Delete a category from the tree
+// @Description Removes a category without subcategories. Medicines and coupon maps naming it are kept, the category then only matches itself
+// @Tags Categories
+// @Produce json
+// @Param name path string true "Category name"
+// @Success 200 {object} map[string]interface{} "Category deleted"
+// @Failure 404 {object} Problem "Category not found"
+// @Failure 409 {object} Problem "Category has subcategories"
+// @Security ApiKeyAuth
+// @Router /admin/categories/{name} [delete]
+func deleteCategoryHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	name, err := categoryName(c)
+	if err != nil {
+		return err
+	}
+
+	tag, err := connPool.Exec(c.Context(), `DELETE FROM category WHERE name = $1`, name)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return newProblem(fiber.StatusConflict, codeCategoryHasChildren,
+			"Category has subcategories, move or delete them first")
+	}
+	if err != nil {
+		return databaseProblem(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return newProblem(fiber.StatusNotFound, codeNotFound, "Category not found")
+	}
+	return c.JSON(fiber.Map{
+		"category": name,
+		"message":  "Category deleted",
+	})
+}
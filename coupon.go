@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// querier is satisfied by both *pgxpool.Pool and pgx.Tx so the coupon checks can run
+// either standalone or inside the reserve/commit transactions.
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// couponEvaluation is the outcome of checking a coupon against an order
+type couponEvaluation struct {
+	IsValid         bool
+	Message         string
+	ItemsDiscount   float64
+	ChargesDiscount float64
+
+	// WindowStart is the start of the usage window a time_based coupon is redeemed in,
+	// nil for the other usage types
+	WindowStart *time.Time
+
+	// CapApplied reports that the discount was clamped to max_discount_amount
+	CapApplied bool
+
+	// ChargesAfterDiscount is what the user still pays for each charge
+	ChargesAfterDiscount OrderCharges
+
+	// Breakdown is the discount given to every line the coupon targets
+	Breakdown []DiscountLine
+
+	// Rejections are the rules an invalid coupon failed
+	Rejections []CouponRejection
+}
+
+// OrderValueAfterDiscount is the cart total plus charges, less every discount
+func (e couponEvaluation) OrderValueAfterDiscount(order OrderInput) float64 {
+	return order.OrderTotal + order.Charges.Total() - (e.ItemsDiscount + e.ChargesDiscount)
+}
+
+// discountedOrder returns the order as it is left to pay after the evaluation's discounts, so the
+// next coupon of a stack is applied on the already discounted amounts. order_total is kept as is,
+// min_order_value is always checked against the repriced subtotal.
+func (e couponEvaluation) discountedOrder(order OrderInput) OrderInput {
+	items := make([]Medicine, len(order.CartItems))
+	copy(items, order.CartItems)
+	for _, line := range e.Breakdown {
+		if line.Kind == lineKindItem && line.Discount > 0 {
+			item := &items[line.item]
+			item.Price = (item.LineTotal() - line.Discount) / float64(item.Quantity)
+		}
+	}
+	order.CartItems = items
+	order.Charges = e.ChargesAfterDiscount
+	return order
+}
+
+// couponColumns are the coupon columns read by scanCoupon, nullable ones are defaulted
+const couponColumns = `c.coupon_code,
+	c.expiry_date,
+	c.usage_type,
+	COALESCE(c.min_order_value, 0),
+	COALESCE(c.valid_from, 'epoch'::timestamp),
+	COALESCE(c.valid_until, c.expiry_date),
+	c.discount_type,
+	c.discount_value,
+	c.discount_target,
+	COALESCE(c.max_usage_per_user, 0),
+	COALESCE(c.terms_and_conditions, ''),
+	c.stackable,
+	COALESCE(c.exclusivity_group, ''),
+	c.priority,
+	COALESCE(c.max_discount_amount, 0),
+	COALESCE(c.max_total_redemptions, 0),
+	COALESCE(c.total_budget, 0),
+	c.is_active,
+	c.version,
+	c.is_template,
+	c.campaign_id,
+	c.is_personal,
+	COALESCE(c.order_condition::text, ''),
+	COALESCE(c.order_number, 0),
+	COALESCE(c.inactive_days, 0)`
+
+// scanCoupon reads a row selected with couponColumns. The maps and schedules are left empty.
+func scanCoupon(row pgx.Row, coupon *CouponData) error {
+	var active bool
+	err := row.Scan(
+		&coupon.CouponCode,
+		&coupon.ExpiryDate,
+		&coupon.UsageType,
+		&coupon.MinOrderValue,
+		&coupon.ValidFrom,
+		&coupon.ValidUntil,
+		&coupon.DiscountType,
+		&coupon.DiscountValue,
+		&coupon.DiscountTarget,
+		&coupon.MaxUsagePerUser,
+		&coupon.TermsAndConditions,
+		&coupon.Stackable,
+		&coupon.ExclusivityGroup,
+		&coupon.Priority,
+		&coupon.MaxDiscountAmount,
+		&coupon.MaxTotalRedemptions,
+		&coupon.TotalBudget,
+		&active,
+		&coupon.version,
+		&coupon.template,
+		&coupon.campaignID,
+		&coupon.Personal,
+		&coupon.OrderCondition,
+		&coupon.OrderNumber,
+		&coupon.InactiveDays)
+	coupon.inactive = !active
+	return err
+}
+
+// loadCoupon reads a coupon together with its medicine and category maps and its schedules.
+// pgx.ErrNoRows is returned when the coupon does not exist.
+func loadCoupon(ctx context.Context, q querier, couponCode string) (CouponData, error) {
+	var coupon CouponData
+	err := scanCoupon(q.QueryRow(ctx, `SELECT `+couponColumns+` FROM coupon c WHERE c.coupon_code = $1`, couponCode), &coupon)
+	if err != nil {
+		return coupon, err
+	}
+	if coupon.campaignID != nil {
+		return loadCampaignCoupon(ctx, q, coupon)
+	}
+
+	coupons := []CouponData{coupon}
+	err = loadCouponRules(ctx, q, coupons)
+	return coupons[0], err
+}
+
+// queryCoupons reads the coupons of the query, which continues `SELECT couponColumns FROM coupon c`,
+// together with their maps and schedules
+func queryCoupons(ctx context.Context, q querier, query string, args ...any) ([]CouponData, error) {
+	rows, _ := q.Query(ctx, `SELECT `+couponColumns+` FROM coupon c `+query, args...)
+	coupons := []CouponData{}
+	for rows.Next() {
+		var coupon CouponData
+		if err := scanCoupon(rows, &coupon); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		coupons = append(coupons, coupon)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	err := loadCouponRules(ctx, q, coupons)
+	return coupons, err
+}
+
+// loadCouponRules fills in the medicine and category maps, the exclusions and the schedules of the coupons
+func loadCouponRules(ctx context.Context, q querier, coupons []CouponData) error {
+	codes := make([]string, len(coupons))
+	for i, coupon := range coupons {
+		codes[i] = coupon.CouponCode
+	}
+
+	medicines := make(map[string][]string)
+	var code, value string
+	rows, _ := q.Query(ctx, `SELECT coupon_code, medicine_id::text FROM coupon_medicine_map
+		WHERE coupon_code = ANY($1) ORDER BY medicine_id`, codes)
+	_, err := pgx.ForEachRow(rows, []any{&code, &value}, func() error {
+		medicines[code] = append(medicines[code], value)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	categories := make(map[string][]string)
+	rows, _ = q.Query(ctx, `SELECT coupon_code, category_name FROM coupon_category_map
+		WHERE coupon_code = ANY($1) ORDER BY category_name`, codes)
+	_, err = pgx.ForEachRow(rows, []any{&code, &value}, func() error {
+		categories[code] = append(categories[code], value)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	excludedMedicines := make(map[string][]string)
+	rows, _ = q.Query(ctx, `SELECT coupon_code, medicine_id::text FROM coupon_medicine_exclusion
+		WHERE coupon_code = ANY($1) ORDER BY medicine_id`, codes)
+	_, err = pgx.ForEachRow(rows, []any{&code, &value}, func() error {
+		excludedMedicines[code] = append(excludedMedicines[code], value)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	excludedCategories := make(map[string][]string)
+	rows, _ = q.Query(ctx, `SELECT coupon_code, category_name FROM coupon_category_exclusion
+		WHERE coupon_code = ANY($1) ORDER BY category_name`, codes)
+	_, err = pgx.ForEachRow(rows, []any{&code, &value}, func() error {
+		excludedCategories[code] = append(excludedCategories[code], value)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	schedules, err := loadCouponSchedules(ctx, q, codes)
+	if err != nil {
+		return err
+	}
+
+	for i := range coupons {
+		coupons[i].ApplicableMedicineId = medicines[coupons[i].CouponCode]
+		coupons[i].ApplicableCategories = categories[coupons[i].CouponCode]
+		coupons[i].ExcludedMedicineId = excludedMedicines[coupons[i].CouponCode]
+		coupons[i].ExcludedCategories = excludedCategories[coupons[i].CouponCode]
+		coupons[i].Schedules = schedules[coupons[i].CouponCode]
+	}
+	return nil
+}
+
+// couponCovers reports whether the coupon applies to the cart item. The item must be in the coupon's
+// medicine or category map and in none of its exclusions, an exclusion wins over an inclusion.
+// A coupon mapped to no medicine or category is site-wide and covers every item but its exclusions,
+// medicines whose category is not in the tree included.
+// A category covers its subcategories, so the item's category is matched through its lineage.
+func couponCovers(coupon CouponData, item Medicine, lineage map[string][]string) bool {
+	categories, found := lineage[item.Category]
+	if !found {
+		categories = []string{item.Category}
+	}
+	id := item.ID.String()
+	inAny := func(list []string) bool {
+		return slices.ContainsFunc(categories, func(category string) bool { return slices.Contains(list, category) })
+	}
+	if slices.Contains(coupon.ExcludedMedicineId, id) || inAny(coupon.ExcludedCategories) {
+		return false
+	}
+	return siteWide(coupon) || slices.Contains(coupon.ApplicableMedicineId, id) || inAny(coupon.ApplicableCategories)
+}
+
+// siteWide reports whether the coupon is mapped to no medicine or category
+func siteWide(coupon CouponData) bool {
+	return len(coupon.ApplicableMedicineId) == 0 && len(coupon.ApplicableCategories) == 0
+}
+
+// chargesOnly reports whether the coupon only discounts the order's charges and is not mapped to any
+// medicine or category. Such a coupon, like free delivery, applies to any cart.
+func chargesOnly(coupon CouponData) bool {
+	return (coupon.DiscountType == "free_delivery" || coupon.DiscountTarget == "charges") && siteWide(coupon)
+}
+
+// siteWideCondition is siteWide as an SQL condition on coupon c, campaign codes aside, for the
+// queries finding the coupons of a cart through the maps. Exclusions are left to the evaluation.
+const siteWideCondition = `(c.campaign_id IS NULL
+	AND NOT EXISTS (SELECT 1 FROM coupon_medicine_map m WHERE m.coupon_code = c.coupon_code)
+	AND NOT EXISTS (SELECT 1 FROM coupon_category_map m WHERE m.coupon_code = c.coupon_code))`
+
+// coversCart reports whether the coupon applies to any item of the cart, a charges only coupon
+// applies to every cart
+func coversCart(coupon CouponData, order OrderInput, lineage map[string][]string) bool {
+	if chargesOnly(coupon) {
+		return true
+	}
+	for _, item := range order.CartItems {
+		if couponCovers(coupon, item, lineage) {
+			return true
+		}
+	}
+	return false
+}
+
+// coveredLines are the cart lines the coupon applies to, one per covered item
+func coveredLines(coupon CouponData, order OrderInput, lineage map[string][]string) []DiscountLine {
+	var items []DiscountLine
+	for i, item := range order.CartItems {
+		if couponCovers(coupon, item, lineage) {
+			items = append(items, DiscountLine{
+				item:     i,
+				Line:     item.ID.String(),
+				Kind:     lineKindItem,
+				Quantity: item.Quantity,
+				Amount:   item.LineTotal(),
+			})
+		}
+	}
+	return items
+}
+
+// evaluateCoupon checks the validity window, the user's usage and the cart against the coupon
+// and calculates the discount. It never changes the user's usage.
+// Every rule is checked so an invalid evaluation lists all the rules the coupon failed, Message is
+// the first of them.
+// The cart is expected to be repriced by priceCart, its prices and order_total are trusted as is.
+func evaluateCoupon(ctx context.Context, q querier, coupon CouponData, req ValidateCoupon) (couponEvaluation, error) {
+	timestamp := req.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	var rejections []CouponRejection
+
+	//a deactivated coupon can't be used until an admin reactivates it
+	if coupon.inactive {
+		rejections = append(rejections, CouponRejection{Code: reasonInactive, Message: "Coupon has been deactivated"})
+	}
+
+	//a campaign template is only redeemed through the codes generated from it
+	if coupon.template {
+		rejections = append(rejections, CouponRejection{Code: reasonCampaignTemplate, Message: "Coupon is a campaign template, use one of its campaign codes"})
+	}
+
+	//a personal coupon is only used by the users it is assigned to, directly or through a cohort
+	if coupon.Personal {
+		assigned, err := couponAssignedTo(ctx, q, coupon.CouponCode, req.UserID)
+		if err != nil {
+			return couponEvaluation{}, err
+		}
+		if !assigned {
+			rejections = append(rejections, CouponRejection{Code: reasonNotAssigned, Message: "Coupon is not assigned to this user"})
+		}
+	}
+
+	//checks the coupon validity using the valid_from, valid_until, expiry_date and the coupon's schedules
+	validity := checkValidity(coupon, timestamp)
+	if validity != nil {
+		rejections = append(rejections, *validity)
+	}
+
+	//checks the user usage vs coupon's max usage, time_based coupons count usage per window.
+	//Outside its windows a time_based coupon has no usage to count.
+	windowStart := usageWindowStart(coupon, timestamp)
+	if coupon.UsageType != usageTimeBased || windowStart != nil {
+		usage, err := userCouponUsage(ctx, q, req.UserID, coupon.CouponCode, windowStart)
+		if err != nil {
+			return couponEvaluation{}, err
+		}
+		if limit := userUsageLimit(coupon); limit > 0 && usage >= limit {
+			rejections = append(rejections, CouponRejection{Code: reasonUsageLimit, Message: "Coupon usage limit exceeded for this user"})
+		}
+	}
+
+	//a campaign code counts towards the template's per-user limit, whichever of its codes the user holds
+	if coupon.templateCode != "" && coupon.campaignUserLimit > 0 && !rejected(rejections, reasonUsageLimit) {
+		usage, err := campaignUserUsage(ctx, q, req.UserID, coupon.templateCode)
+		if err != nil {
+			return couponEvaluation{}, err
+		}
+		if usage >= coupon.campaignUserLimit {
+			rejections = append(rejections, CouponRejection{Code: reasonUsageLimit, Message: "Campaign usage limit exceeded for this user"})
+		}
+	}
+
+	//order-history conditions are checked against the orders the user has placed so far
+	if coupon.OrderCondition != "" {
+		history, err := loadOrderHistory(ctx, q, req.UserID, "")
+		if err != nil {
+			return couponEvaluation{}, err
+		}
+		if rejection := checkOrderCondition(coupon, history, timestamp); rejection != nil {
+			rejections = append(rejections, *rejection)
+		}
+	}
+
+	//checks the min Order value of the cart
+	if req.OrderTotal < coupon.MinOrderValue {
+		rejections = append(rejections, belowMinOrder(coupon, req.OrderTotal))
+	}
+
+	//filters out the cart items not covered by the coupon's medicines or categories, or excluded from it
+	var lineage map[string][]string
+	if len(coupon.ApplicableCategories) > 0 || len(coupon.ExcludedCategories) > 0 {
+		var err error
+		lineage, err = cartCategoryLineage(ctx, q, req.OrderInput)
+		if err != nil {
+			return couponEvaluation{}, err
+		}
+	}
+	items := coveredLines(coupon, req.OrderInput, lineage)
+	if len(items) == 0 && !chargesOnly(coupon) {
+		rejections = append(rejections, CouponRejection{Code: reasonNoEligibleItems, Message: "No items in the cart are eligible for this coupon"})
+		return invalidEvaluation(rejections), nil
+	}
+
+	//Discount is calculated per line on inventory and charges
+	lines, capApplied := calculateDiscount(coupon, items, req.Charges)
+
+	//checks the coupon's global redemption cap and budget
+	budget, err := loadCouponBudget(ctx, q, coupon.CouponCode)
+	if err != nil {
+		return couponEvaluation{}, err
+	}
+	discount := sumDiscounts(lines, lineKindItem) + sumDiscounts(lines, lineKindCharge)
+	if rejection := budget.check(discount); rejection != nil {
+		rejections = append(rejections, *rejection)
+	}
+
+	//a campaign code also draws from the template's redemption cap and budget, shared by all its codes
+	if coupon.templateCode != "" {
+		campaign, err := loadCouponBudget(ctx, q, coupon.templateCode)
+		if err != nil {
+			return couponEvaluation{}, err
+		}
+		if rejection := campaign.check(discount); rejection != nil {
+			rejections = append(rejections, *rejection)
+		}
+	}
+	if len(rejections) > 0 {
+		return invalidEvaluation(rejections), nil
+	}
+
+	return couponEvaluation{
+		IsValid:              true,
+		Message:              "Coupon applied succesfully",
+		WindowStart:          windowStart,
+		ItemsDiscount:        sumDiscounts(lines, lineKindItem),
+		ChargesDiscount:      sumDiscounts(lines, lineKindCharge),
+		CapApplied:           capApplied,
+		ChargesAfterDiscount: req.Charges.afterDiscount(lines),
+		Breakdown:            lines,
+	}, nil
+}
+
+// rejected reports whether the coupon already failed the rule with the reason code
+func rejected(rejections []CouponRejection, code string) bool {
+	return slices.ContainsFunc(rejections, func(rejection CouponRejection) bool { return rejection.Code == code })
+}
+
+// invalidEvaluation is the evaluation of a coupon that failed the given rules
+func invalidEvaluation(rejections []CouponRejection) couponEvaluation {
+	return couponEvaluation{Message: rejections[0].Message, Rejections: rejections}
+}
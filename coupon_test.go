@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+var (
+	paracetamol  = Medicine{ID: uuid.MustParse("3fa85f64-5717-4562-b3fc-2c963f66afa6"), Category: "Pain Relief", Price: 25, Quantity: 2}
+	atorvastatin = Medicine{ID: uuid.MustParse("1a2c3d4e-5f6a-7b8c-9d0e-1f2a3b4c5d6e"), Category: "Cholesterol", Price: 45, Quantity: 1}
+	amoxicillin  = Medicine{ID: uuid.MustParse("7b9d71f6-0b8e-4e12-b6b3-1cd5cf9243a0"), Category: "Antibiotics", Price: 50, Quantity: 1}
+
+	// multivitamin's category is not in the category tree
+	multivitamin = Medicine{ID: uuid.MustParse("5b0e2c1a-9d3f-4c7e-8a21-6f4d3e2b1c0a"), Category: "Vitamins", Price: 30, Quantity: 1}
+)
+
+// seedLineage is the lineage cartCategoryLineage finds in the init.sql category tree
+var seedLineage = map[string][]string{
+	"Pain Relief": {"Pain Relief"},
+	"Cholesterol": {"Cholesterol", "Cardiac care"},
+	"Antibiotics": {"Antibiotics"},
+}
+
+func TestCouponCovers(t *testing.T) {
+	coupons := seedCoupons(t)
+	siteWide := seedCoupon(t, coupons, "SAVE5ALL")
+
+	exceptCardiac := siteWide
+	exceptCardiac.ExcludedCategories = []string{"Cardiac care"}
+
+	exceptParacetamol := siteWide
+	exceptParacetamol.ExcludedMedicineId = []string{paracetamol.ID.String()}
+
+	antibiotics := seedCoupon(t, coupons, "ANTIBIO10")
+	antibiotics.ApplicableCategories = []string{"Antibiotics"}
+
+	tests := []struct {
+		name   string
+		coupon CouponData
+		item   Medicine
+		want   bool
+	}{
+		{"site-wide covers any item", siteWide, paracetamol, true},
+		{"site-wide covers a medicine outside the category tree", siteWide, multivitamin, true},
+		{"site-wide excluding a category skips its subcategories", exceptCardiac, atorvastatin, false},
+		{"site-wide excluding a category covers the rest", exceptCardiac, paracetamol, true},
+		{"site-wide excluding a medicine skips it", exceptParacetamol, paracetamol, false},
+		{"mapped coupon covers its category", antibiotics, amoxicillin, true},
+		{"mapped coupon skips other categories", antibiotics, paracetamol, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := couponCovers(tt.coupon, tt.item, seedLineage); got != tt.want {
+				t.Errorf("couponCovers() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSiteWideDiscount(t *testing.T) {
+	coupons := seedCoupons(t)
+	coupon := seedCoupon(t, coupons, "SAVE5ALL")
+	coupon.ExcludedCategories = []string{"Cardiac care"}
+
+	order := OrderInput{CartItems: []Medicine{paracetamol, atorvastatin}, OrderTotal: 95}
+	if !coversCart(coupon, order, seedLineage) {
+		t.Fatal("coversCart() = false, want true")
+	}
+
+	// 5% of the paracetamol line only, atorvastatin is excluded through Cardiac care
+	lines, _ := calculateDiscount(coupon, coveredLines(coupon, order, seedLineage), order.Charges)
+	if got := sumDiscounts(lines, lineKindItem); math.Abs(got-2.5) > amountTolerance {
+		t.Errorf("items discount = %.2f, want 2.50", got)
+	}
+
+	excluded := OrderInput{CartItems: []Medicine{atorvastatin}, OrderTotal: 45}
+	if coversCart(coupon, excluded, seedLineage) {
+		t.Error("coversCart() of a cart of excluded items = true, want false")
+	}
+	if freeDelivery := seedCoupon(t, coupons, "FREEDEL99"); !coversCart(freeDelivery, excluded, seedLineage) {
+		t.Error("coversCart() of a charges only coupon = false, want true")
+	}
+}
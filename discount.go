@@ -0,0 +1,134 @@
+package main
+
+import "math"
+
+// Line kinds of a DiscountLine
+const (
+	lineKindItem   = "item"
+	lineKindCharge = "charge"
+)
+
+// Charge line names used in the per-line discount breakdown
+const (
+	chargeDelivery          = "delivery"
+	chargePackaging         = "packaging"
+	chargePlatformFee       = "platform_fee"
+	chargeColdChainHandling = "cold_chain_handling"
+)
+
+// DiscountLine is one priced line of an order and the discount a coupon gave it
+type DiscountLine struct {
+	// item is the index of the cart item an item line was built from
+	item int
+
+	Line     string  `json:"line"`
+	Kind     string  `json:"kind"`
+	Quantity int     `json:"quantity,omitempty"`
+	Amount   float64 `json:"amount"`
+	Discount float64 `json:"discount"`
+}
+
+// Lines breaks the charges into one line per charge, skipping the ones that are not billed
+func (charges OrderCharges) Lines() []DiscountLine {
+	var lines []DiscountLine
+	for _, charge := range []struct {
+		name   string
+		amount float64
+	}{
+		{chargeDelivery, charges.Delivery},
+		{chargePackaging, charges.Packaging},
+		{chargePlatformFee, charges.PlatformFee},
+		{chargeColdChainHandling, charges.ColdChainHandling},
+	} {
+		if charge.amount > 0 {
+			lines = append(lines, DiscountLine{Line: charge.name, Kind: lineKindCharge, Amount: charge.amount})
+		}
+	}
+	return lines
+}
+
+// afterDiscount returns the charges left to pay once the discounted charge lines are taken off
+func (charges OrderCharges) afterDiscount(lines []DiscountLine) OrderCharges {
+	for _, line := range lines {
+		if line.Kind != lineKindCharge {
+			continue
+		}
+		switch line.Line {
+		case chargeDelivery:
+			charges.Delivery -= line.Discount
+		case chargePackaging:
+			charges.Packaging -= line.Discount
+		case chargePlatformFee:
+			charges.PlatformFee -= line.Discount
+		case chargeColdChainHandling:
+			charges.ColdChainHandling -= line.Discount
+		}
+	}
+	return charges
+}
+
+// calculateDiscount spreads a coupon's discount over the order lines it targets.
+// items are the cart lines eligible for the coupon, charges are only discounted when the coupon
+// targets them. Percentages apply per line, a flat amount is split across the targeted lines in
+// proportion to their amount and free_delivery waives the delivery line. No line is discounted
+// below zero. A percentage discount above max_discount_amount is scaled down to the cap, the
+// returned flag reports when that happened.
+func calculateDiscount(coupon CouponData, items []DiscountLine, charges OrderCharges) ([]DiscountLine, bool) {
+	var lines []DiscountLine
+	if coupon.DiscountType == "free_delivery" {
+		for _, line := range charges.Lines() {
+			if line.Line == chargeDelivery {
+				line.Discount = line.Amount
+				lines = append(lines, line)
+			}
+		}
+		return lines, false
+	}
+
+	if coupon.DiscountTarget == "inventory" || coupon.DiscountTarget == "inventory_and_charges" {
+		lines = append(lines, items...)
+	}
+	if coupon.DiscountTarget == "charges" || coupon.DiscountTarget == "inventory_and_charges" {
+		lines = append(lines, charges.Lines()...)
+	}
+
+	var total float64
+	for _, line := range lines {
+		total += line.Amount
+	}
+	if total <= 0 {
+		return lines, false
+	}
+
+	var discount float64
+	for i := range lines {
+		switch coupon.DiscountType {
+		case "percentage":
+			lines[i].Discount = lines[i].Amount * (coupon.DiscountValue / 100)
+		case "flat":
+			lines[i].Discount = math.Min(coupon.DiscountValue, total) * (lines[i].Amount / total)
+		}
+		lines[i].Discount = math.Min(lines[i].Discount, lines[i].Amount)
+		discount += lines[i].Discount
+	}
+
+	if coupon.DiscountType != "percentage" || coupon.MaxDiscountAmount <= 0 || discount <= coupon.MaxDiscountAmount {
+		return lines, false
+	}
+	scale := coupon.MaxDiscountAmount / discount
+	for i := range lines {
+		lines[i].Discount *= scale
+	}
+	return lines, true
+}
+
+// sumDiscounts totals the discount given to lines of one kind
+func sumDiscounts(lines []DiscountLine, kind string) float64 {
+	var total float64
+	for _, line := range lines {
+		if line.Kind == kind {
+			total += line.Discount
+		}
+	}
+	return total
+}
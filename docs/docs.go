@@ -61,23 +61,32 @@ const docTemplate = `{
                     "400": {
                         "description": "Validation errors",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": true
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Coupon code already exists",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": true
+                            "$ref": "#/definitions/main.Problem"
                         }
                     }
                 }
             }
         },
-        "/coupon/applicable": {
+        "/admin/campaigns": {
             "post": {
-                "description": "Returns coupons applicable to the provided cart items",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Turns the coupon into a campaign template and generates count unique single-use codes from the pattern. Codes are evaluated with the template's current terms, maps and schedules, the template itself can no longer be redeemed",
                 "consumes": [
                     "application/json"
                 ],
@@ -85,51 +94,89 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "Coupons"
+                    "Campaigns"
                 ],
-                "summary": "Get applicable coupons",
+                "summary": "Create a campaign of single-use codes",
                 "parameters": [
                     {
-                        "description": "Cart items",
-                        "name": "cart",
+                        "description": "Campaign, template coupon and code pattern",
+                        "name": "request",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/main.OrderInput"
+                            "$ref": "#/definitions/main.CreateCampaignRequest"
                         }
                     }
                 ],
                 "responses": {
-                    "200": {
-                        "description": "List of applicable coupons",
+                    "201": {
+                        "description": "Campaign",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": {
-                                "type": "array",
-                                "items": {
-                                    "$ref": "#/definitions/main.ApplicableCoupon"
-                                }
-                            }
+                            "$ref": "#/definitions/main.Campaign"
                         }
                     },
                     "400": {
-                        "description": "Bad request",
+                        "description": "Validation errors",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": true
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Template coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/campaigns/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Campaigns"
+                ],
+                "summary": "Get a campaign",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Campaign ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Campaign",
+                        "schema": {
+                            "$ref": "#/definitions/main.Campaign"
+                        }
+                    },
+                    "404": {
+                        "description": "Campaign not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
                         }
                     }
                 }
             }
         },
-        "/coupon/update": {
+        "/admin/campaigns/{id}/codes": {
             "post": {
                 "security": [
                     {
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "Update coupon details",
+                "description": "Adds count codes drawn from the campaign's pattern",
                 "consumes": [
                     "application/json"
                 ],
@@ -137,48 +184,122 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "Admin"
+                    "Campaigns"
                 ],
-                "summary": "Update an existing coupon",
+                "summary": "Generate more codes for a campaign",
                 "parameters": [
                     {
-                        "description": "Coupon update data",
-                        "name": "coupon",
+                        "type": "integer",
+                        "description": "Campaign ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "How many codes",
+                        "name": "request",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/main.UpdateCouponRequest"
+                            "$ref": "#/definitions/main.GenerateCodesRequest"
                         }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "Success message",
+                        "description": "Campaign",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": true
+                            "$ref": "#/definitions/main.Campaign"
                         }
                     },
                     "400": {
-                        "description": "Bad request",
+                        "description": "Validation errors",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": true
+                            "$ref": "#/definitions/main.Problem"
                         }
                     },
-                    "500": {
-                        "description": "Internal server error",
+                    "404": {
+                        "description": "Campaign not found",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": true
+                            "$ref": "#/definitions/main.Problem"
                         }
                     }
                 }
             }
         },
-        "/coupon/validate": {
+        "/admin/campaigns/{id}/export": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Streams every code of the campaign as CSV with whether it is active and redeemed, for the SMS provider. The codes are sent in chunks as they are read, a failure part way cuts the CSV short",
+                "produces": [
+                    "text/csv"
+                ],
+                "tags": [
+                    "Campaigns"
+                ],
+                "summary": "Export the codes of a campaign",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Campaign ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "coupon_code,is_active,redeemed",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Campaign not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/categories": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Categories"
+                ],
+                "summary": "Get the category tree",
+                "responses": {
+                    "200": {
+                        "description": "Root categories with their subcategories",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.CategoryNode"
+                            }
+                        }
+                    }
+                }
+            },
             "post": {
-                "description": "Check if a coupon is valid for the given order",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Adds a root category, or a subcategory when parent is set. Coupons targeting the parent cover the new category's medicines",
                 "consumes": [
                     "application/json"
                 ],
@@ -186,81 +307,2519 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "Coupons"
+                    "Categories"
                 ],
-                "summary": "Validate a coupon",
+                "summary": "Add a category to the tree",
                 "parameters": [
                     {
-                        "description": "Validation request",
+                        "description": "Category",
                         "name": "request",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/main.ValidateCoupon"
+                            "$ref": "#/definitions/main.CreateCategoryRequest"
                         }
                     }
                 ],
                 "responses": {
-                    "200": {
-                        "description": "Validation result",
+                    "201": {
+                        "description": "Category",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": true
+                            "$ref": "#/definitions/main.CategoryNode"
                         }
                     },
                     "400": {
-                        "description": "Bad request",
+                        "description": "Validation errors or unknown parent",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Category already exists",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/categories/{name}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Categories"
+                ],
+                "summary": "Get a category with its subcategories",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Category name",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Category",
+                        "schema": {
+                            "$ref": "#/definitions/main.CategoryNode"
+                        }
+                    },
+                    "404": {
+                        "description": "Category not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Removes a category without subcategories. Medicines and coupon maps naming it are kept, the category then only matches itself",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Categories"
+                ],
+                "summary": "Delete a category from the tree",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Category name",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Category deleted",
                         "schema": {
                             "type": "object",
                             "additionalProperties": true
                         }
+                    },
+                    "404": {
+                        "description": "Category not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Category has subcategories",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
                     }
                 }
-            }
-        }
-    },
-    "definitions": {
-        "main.ApplicableCoupon": {
-            "type": "object",
-            "properties": {
-                "coupon_code": {
-                    "type": "string"
-                },
-                "discount_value": {
-                    "type": "number"
+            },
+            "patch": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Moves the category, with its subcategories, under another parent. A null parent makes it a root category. A category can't be moved under itself or one of its subcategories",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Categories"
+                ],
+                "summary": "Move a category in the tree",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Category name",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "New parent",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.MoveCategoryRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Category",
+                        "schema": {
+                            "$ref": "#/definitions/main.CategoryNode"
+                        }
+                    },
+                    "400": {
+                        "description": "Validation errors or unknown parent",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Category not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
                 }
             }
         },
-        "main.CouponData": {
-            "type": "object",
-            "required": [
-                "coupon_code",
-                "discount_Target",
-                "discount_type",
-                "expiry_date",
-                "usage_type",
-                "valid_from",
-                "valid_until"
-            ],
-            "properties": {
-                "applicable_categories": {
-                    "type": "array",
-                    "items": {
-                        "type": "string"
+        "/admin/cohorts": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
                     }
-                },
-                "applicable_medicine_id": {
-                    "type": "array",
-                    "items": {
+                ],
+                "description": "Creates a named group of users that personal coupons can be assigned to",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Personal coupons"
+                ],
+                "summary": "Upload a cohort of users",
+                "parameters": [
+                    {
+                        "description": "Cohort name and user IDs",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.CreateCohortRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Cohort",
+                        "schema": {
+                            "$ref": "#/definitions/main.Cohort"
+                        }
+                    },
+                    "400": {
+                        "description": "Validation errors",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Cohort name already exists",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/cohorts/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Personal coupons"
+                ],
+                "summary": "Get a cohort",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Cohort ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Cohort",
+                        "schema": {
+                            "$ref": "#/definitions/main.Cohort"
+                        }
+                    },
+                    "404": {
+                        "description": "Cohort not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/cohorts/{id}/users": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Personal coupons"
+                ],
+                "summary": "Add users to a cohort",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Cohort ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "User IDs",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponUsersRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Cohort",
+                        "schema": {
+                            "$ref": "#/definitions/main.Cohort"
+                        }
+                    },
+                    "400": {
+                        "description": "Validation errors",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Cohort not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/cohorts/{id}/users/{user_id}": {
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Personal coupons"
+                ],
+                "summary": "Remove a user from a cohort",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Cohort ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "User ID",
+                        "name": "user_id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Cohort",
+                        "schema": {
+                            "$ref": "#/definitions/main.Cohort"
+                        }
+                    },
+                    "404": {
+                        "description": "Cohort not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Pages through the coupons in coupon code order with optional filters",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "List coupons",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "active, upcoming, expired or inactive",
+                        "name": "status",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Coupons mapped to this category",
+                        "name": "category",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "one_time, multi_use or time_based",
+                        "name": "usage_type",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Part of the coupon code",
+                        "name": "search",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Lists the codes of this campaign, with the template's terms and limits, instead of the other coupons",
+                        "name": "campaign_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 1,
+                        "description": "Page number, from 1",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 20,
+                        "description": "Coupons per page, at most 100",
+                        "name": "page_size",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Coupons with the total count",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filter",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons/{code}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Returns the coupon with its medicine and category maps, schedules and whether it is active",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "Get a coupon",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Coupon",
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponDetails"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Deletes a coupon with its maps and schedules. A coupon that has been redeemed or is held by an order can't be deleted, deactivate it instead",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "Delete a coupon",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Coupon deleted",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Coupon has been used or campaign codes were generated from it",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            },
+            "patch": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Changes any coupon field, the coupon_code excepted. Fields left out of the body keep their value, applicable_medicine_id, applicable_categories and schedules replace the current ones when given. The result is validated with the same rules as addCoupons",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "Update an existing coupon",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Fields to change",
+                        "name": "coupon",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponData"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Updated coupon",
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponDetails"
+                        }
+                    },
+                    "400": {
+                        "description": "Validation errors",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons/{code}/budget": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Shows the coupon's redemption cap and budget, what has been redeemed, what active reservations hold and what remains",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "Get a coupon's global redemptions and budget",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Budget",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons/{code}/categories": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Maps the categories to the coupon, categories already mapped are skipped",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "Add categories to a coupon",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Categories",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponCategoriesRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Coupon",
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponDetails"
+                        }
+                    },
+                    "400": {
+                        "description": "Validation errors",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons/{code}/categories/{category}": {
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "Remove a category from a coupon",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Category name",
+                        "name": "category",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Coupon",
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponDetails"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons/{code}/cohorts": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Makes the coupon available to every member of the cohorts and makes it personal",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Personal coupons"
+                ],
+                "summary": "Assign a personal coupon to cohorts",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Cohort IDs",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponCohortsRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Coupon",
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponDetails"
+                        }
+                    },
+                    "400": {
+                        "description": "Validation errors or unknown cohort",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons/{code}/cohorts/{cohort_id}": {
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Personal coupons"
+                ],
+                "summary": "Revoke a personal coupon from a cohort",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Cohort ID",
+                        "name": "cohort_id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Coupon",
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponDetails"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons/{code}/deactivate": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Stops the coupon from being validated, listed as applicable or reserved. Reservations already held can still be committed",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "Deactivate a coupon",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Coupon deactivated",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons/{code}/history": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Lists every change made to the coupon, newest first, with who made it, when and the fields' values before and after. The history of a deleted coupon is kept",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "Get a coupon's version history",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Versions",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon has no history",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons/{code}/medicines": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Maps the medicines to the coupon, medicines already mapped are skipped",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "Add medicines to a coupon",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Medicines",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponMedicinesRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Coupon",
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponDetails"
+                        }
+                    },
+                    "400": {
+                        "description": "Validation errors or unknown medicine",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons/{code}/medicines/{medicine_id}": {
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "Remove a medicine from a coupon",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Medicine ID",
+                        "name": "medicine_id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Coupon",
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponDetails"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons/{code}/reactivate": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Makes a deactivated coupon usable again",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "Reactivate a coupon",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Coupon reactivated",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons/{code}/users": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Adds users to the coupon's allow-list and makes the coupon personal, only assigned users can use it from then on",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Personal coupons"
+                ],
+                "summary": "Assign a personal coupon to users",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "User IDs",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponUsersRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Coupon",
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponDetails"
+                        }
+                    },
+                    "400": {
+                        "description": "Validation errors",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/coupons/{code}/users/{user_id}": {
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Removes the user from the coupon's allow-list. The user keeps the coupon while one of their cohorts is assigned",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Personal coupons"
+                ],
+                "summary": "Revoke a personal coupon from a user",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Coupon code",
+                        "name": "code",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "User ID",
+                        "name": "user_id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Coupon",
+                        "schema": {
+                            "$ref": "#/definitions/main.CouponDetails"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/medicines": {
+            "put": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Inserts the medicines that don't exist and updates the name, category and price of the ones that do, in one transaction. Every medicine needs an id",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Medicines"
+                ],
+                "summary": "Create or update medicines in bulk",
+                "parameters": [
+                    {
+                        "description": "Medicines",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.BulkMedicinesRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Created and updated counts",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Validation errors",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Adds an active medicine. An ID is generated when the body has none",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Medicines"
+                ],
+                "summary": "Add a medicine to the catalogue",
+                "parameters": [
+                    {
+                        "description": "Medicine",
+                        "name": "medicine",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.CatalogueMedicine"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Medicine",
+                        "schema": {
+                            "$ref": "#/definitions/main.CatalogueMedicine"
+                        }
+                    },
+                    "400": {
+                        "description": "Validation errors",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Medicine ID already exists",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/medicines/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Medicines"
+                ],
+                "summary": "Get a medicine",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Medicine ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Medicine",
+                        "schema": {
+                            "$ref": "#/definitions/main.CatalogueMedicine"
+                        }
+                    },
+                    "404": {
+                        "description": "Medicine not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            },
+            "patch": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Changes the name, category or price of a medicine. Fields left out of the body keep their value. The cached row is dropped so carts are priced with the change right away",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Medicines"
+                ],
+                "summary": "Update a medicine",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Medicine ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Fields to change",
+                        "name": "medicine",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.CatalogueMedicine"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Medicine",
+                        "schema": {
+                            "$ref": "#/definitions/main.CatalogueMedicine"
+                        }
+                    },
+                    "400": {
+                        "description": "Validation errors",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Medicine not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/medicines/{id}/deactivate": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Takes the medicine off sale, carts holding it are rejected with INVALID_CART. Coupon maps to it are kept",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Medicines"
+                ],
+                "summary": "Deactivate a medicine",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Medicine ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Medicine",
+                        "schema": {
+                            "$ref": "#/definitions/main.CatalogueMedicine"
+                        }
+                    },
+                    "404": {
+                        "description": "Medicine not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/medicines/{id}/reactivate": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Puts a deactivated medicine back on sale",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Medicines"
+                ],
+                "summary": "Reactivate a medicine",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Medicine ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Medicine",
+                        "schema": {
+                            "$ref": "#/definitions/main.CatalogueMedicine"
+                        }
+                    },
+                    "404": {
+                        "description": "Medicine not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/redemptions": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Pages through the redemptions, newest first, with the discount given and how much of it was reversed",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "List the redemption ledger",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Redemptions of this coupon",
+                        "name": "coupon_code",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Redemptions of this order",
+                        "name": "order_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Redemptions of this user",
+                        "name": "user_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 1,
+                        "description": "Page number, from 1",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 20,
+                        "description": "Redemptions per page, at most 100",
+                        "name": "page_size",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Redemptions with the total count",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filter",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/users/{user_id}/coupons": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Lists the personal coupons assigned to the user, directly or through a cohort, in coupon code order",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Personal coupons"
+                ],
+                "summary": "List a user's personal coupons",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "User ID",
+                        "name": "user_id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Personal coupons",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid user id",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/coupon/applicable": {
+            "post": {
+                "description": "Returns coupons applicable to the provided cart items at the order timestamp, time_based coupons only inside their schedule windows. Discounts are calculated on the cart repriced from the medicine table. Coupons whose order-history condition the user doesn't meet are listed in not_applicable with the reason",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Coupons"
+                ],
+                "summary": "Get applicable coupons",
+                "parameters": [
+                    {
+                        "description": "Cart items and the user, personal coupons are left out without one",
+                        "name": "cart",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ApplicableCouponsRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "List of applicable coupons",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "array",
+                                "items": {
+                                    "$ref": "#/definitions/main.ApplicableCoupon"
+                                }
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/coupon/apply": {
+            "post": {
+                "description": "Applies stackable coupons in priority order, each on the amount left by the ones before it, and returns every coupon's contribution. The user's usage is not consumed",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Coupons"
+                ],
+                "summary": "Apply several coupons to a cart",
+                "parameters": [
+                    {
+                        "description": "Coupons and cart",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ApplyCouponsRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Stacked discount",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Coupons can't be combined or are not applicable",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/coupon/best": {
+            "post": {
+                "description": "Evaluates every coupon mapped to the cart with the full validate rules for the user and ranks them by the actual savings",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Coupons"
+                ],
+                "summary": "Find the best coupon for a cart",
+                "parameters": [
+                    {
+                        "description": "Cart and user",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.BestCouponRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Best coupon with the ranking",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Bad request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/coupon/commit": {
+            "post": {
+                "description": "Redeems every active reservation held by the order, consuming the user's usage slots, and records the redemptions and the order in their ledgers. The redemption ids are the reservation ids",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Coupons"
+                ],
+                "summary": "Commit the coupon reservations of an order",
+                "parameters": [
+                    {
+                        "description": "Order",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ReservationActionRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Retries with the same key replay the first response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Committed coupons",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "An order-history condition no longer holds, such as another order placed first",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "No active reservation",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Order holds reservations of more than one user",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/coupon/explain": {
+            "post": {
+                "description": "Runs every validate rule of each coupon against the cart for the user and lists all the rules a coupon failed with a stable reason code. BELOW_MIN_ORDER carries the shortfall. Without coupon_codes every coupon is explained",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Coupons"
+                ],
+                "summary": "Explain which coupons apply to a cart",
+                "parameters": [
+                    {
+                        "description": "Cart, user and optional coupon codes",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ExplainCouponsRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Explanation per coupon",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Bad request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/coupon/release": {
+            "post": {
+                "description": "Gives back the usage slots held by an order that was not placed",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Coupons"
+                ],
+                "summary": "Release the coupon reservations of an order",
+                "parameters": [
+                    {
+                        "description": "Order",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ReservationActionRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Retries with the same key replay the first response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Released coupons",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "404": {
+                        "description": "No active reservation",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/coupon/reserve": {
+            "post": {
+                "description": "Validates the coupon, or the stack of coupons, and holds one of the user's usage slots per coupon for the order until the TTL lapses",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Coupons"
+                ],
+                "summary": "Reserve coupons for an order",
+                "parameters": [
+                    {
+                        "description": "Reservation request",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ReserveCouponRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Retries with the same key replay the first response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Reservation details",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Coupon not applicable",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Order already holds coupons, belongs to another user or order_total does not match the current prices",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/coupon/reverse": {
+            "post": {
+                "description": "Gives the discount of the order's redemptions back to the coupons' budgets. A reversal of the whole discount left also gives back the user's usage slot and the coupon's redemption. amount reverses part of one coupon's discount for a partial refund. Without coupon_code the order is cancelled: every redemption is reversed in full and the order no longer counts for order-history conditions. An order placed without a coupon, or whose redemptions were all reversed already, is cancelled the same way, with no reversal",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Coupons"
+                ],
+                "summary": "Reverse the coupon redemptions of a cancelled or refunded order",
+                "parameters": [
+                    {
+                        "description": "Order, optional coupon and amount",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ReverseRedemptionRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Retries with the same key replay the first response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Reversals",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Validation errors or amount above the discount left",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "No redemption for the order, nor an order recorded when coupon_code is left out",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Redemption already reversed or order already cancelled",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/coupon/validate": {
+            "post": {
+                "description": "Check if a coupon is valid for the given order. The cart is repriced from the medicine table and a differing order_total is flagged in pricing. The user's usage is not consumed, use /coupon/reserve and /coupon/commit to redeem it",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Coupons"
+                ],
+                "summary": "Validate a coupon",
+                "parameters": [
+                    {
+                        "description": "Validation request",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.ValidateCoupon"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Retries with the same key replay the first response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Validation result",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Bad request",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Coupon not found",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/coupon/wallet/{user_id}": {
+            "get": {
+                "description": "Lists the public coupons and the personal coupons assigned to the user, grouped into active, upcoming and used_or_expired, with the uses left and the time left before the coupon expires. Expired and sold out coupons are only listed when the user used them or they were assigned to the user",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Coupons"
+                ],
+                "summary": "Get a user's coupon wallet",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "User ID",
+                        "name": "user_id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Wallet",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid user id",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/orders": {
+            "post": {
+                "description": "Adds the order to the ledger order-history coupon conditions are checked against. Orders redeeming a coupon are recorded by /coupon/commit, orders placed without a coupon have to be recorded here. Recording an order again is a no-op. The order is placed when it is recorded",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Coupons"
+                ],
+                "summary": "Record a placed order",
+                "parameters": [
+                    {
+                        "description": "Order",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.RecordOrderRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "User's order history",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "400": {
+                        "description": "Validation errors",
+                        "schema": {
+                            "$ref": "#/definitions/main.Problem"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "main.ApplicableCoupon": {
+            "type": "object",
+            "properties": {
+                "cap_applied": {
+                    "type": "boolean"
+                },
+                "condition": {
+                    "type": "string"
+                },
+                "coupon_code": {
+                    "type": "string"
+                },
+                "discount_value": {
+                    "type": "number"
+                }
+            }
+        },
+        "main.ApplicableCouponsRequest": {
+            "type": "object",
+            "properties": {
+                "cart_items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Medicine"
+                    }
+                },
+                "charges": {
+                    "$ref": "#/definitions/main.OrderCharges"
+                },
+                "order_total": {
+                    "type": "number"
+                },
+                "timestamp": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.ApplyCouponsRequest": {
+            "type": "object",
+            "properties": {
+                "cart_items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Medicine"
+                    }
+                },
+                "charges": {
+                    "$ref": "#/definitions/main.OrderCharges"
+                },
+                "coupon_codes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "order_total": {
+                    "type": "number"
+                },
+                "timestamp": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.BestCouponRequest": {
+            "type": "object",
+            "properties": {
+                "cart_items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Medicine"
+                    }
+                },
+                "charges": {
+                    "$ref": "#/definitions/main.OrderCharges"
+                },
+                "order_total": {
+                    "type": "number"
+                },
+                "timestamp": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.BulkMedicinesRequest": {
+            "type": "object",
+            "required": [
+                "medicines"
+            ],
+            "properties": {
+                "medicines": {
+                    "type": "array",
+                    "maxItems": 1000,
+                    "minItems": 1,
+                    "items": {
+                        "$ref": "#/definitions/main.CatalogueMedicine"
+                    }
+                }
+            }
+        },
+        "main.Campaign": {
+            "type": "object",
+            "properties": {
+                "alphabet": {
+                    "type": "string"
+                },
+                "campaign_id": {
+                    "type": "integer"
+                },
+                "code_count": {
+                    "type": "integer"
+                },
+                "code_length": {
+                    "type": "integer"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "created_by": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "prefix": {
+                    "type": "string"
+                },
+                "redeemed_count": {
+                    "type": "integer"
+                },
+                "template_code": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.CartPricing": {
+            "type": "object",
+            "properties": {
+                "client_total": {
+                    "type": "number"
+                },
+                "price_mismatch": {
+                    "type": "boolean"
+                },
+                "subtotal": {
+                    "type": "number"
+                }
+            }
+        },
+        "main.CatalogueMedicine": {
+            "type": "object",
+            "required": [
+                "category",
+                "name"
+            ],
+            "properties": {
+                "category": {
+                    "type": "string",
+                    "maxLength": 100
+                },
+                "id": {
+                    "type": "string"
+                },
+                "is_active": {
+                    "type": "boolean"
+                },
+                "name": {
+                    "type": "string",
+                    "maxLength": 255
+                },
+                "price": {
+                    "type": "number"
+                }
+            }
+        },
+        "main.CategoryNode": {
+            "type": "object",
+            "properties": {
+                "children": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.CategoryNode"
+                    }
+                },
+                "name": {
+                    "type": "string"
+                },
+                "parent": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.Cohort": {
+            "type": "object",
+            "properties": {
+                "cohort_id": {
+                    "type": "integer"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "created_by": {
+                    "type": "string"
+                },
+                "member_count": {
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.CouponCategoriesRequest": {
+            "type": "object",
+            "required": [
+                "categories"
+            ],
+            "properties": {
+                "categories": {
+                    "type": "array",
+                    "minItems": 1,
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "main.CouponCohortsRequest": {
+            "type": "object",
+            "required": [
+                "cohort_ids"
+            ],
+            "properties": {
+                "cohort_ids": {
+                    "type": "array",
+                    "minItems": 1,
+                    "items": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "main.CouponData": {
+            "type": "object",
+            "required": [
+                "applicable_categories",
+                "coupon_code",
+                "discount_target",
+                "discount_type",
+                "excluded_categories",
+                "expiry_date",
+                "usage_type",
+                "valid_from",
+                "valid_until"
+            ],
+            "properties": {
+                "applicable_categories": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "applicable_medicine_id": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "coupon_code": {
+                    "type": "string",
+                    "maxLength": 50,
+                    "minLength": 3
+                },
+                "discount_target": {
+                    "type": "string",
+                    "enum": [
+                        "inventory",
+                        "charges",
+                        "inventory_and_charges"
+                    ]
+                },
+                "discount_type": {
+                    "type": "string",
+                    "enum": [
+                        "flat",
+                        "percentage",
+                        "free_delivery"
+                    ]
+                },
+                "discount_value": {
+                    "type": "number",
+                    "minimum": 0
+                },
+                "excluded_categories": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "excluded_medicine_id": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "exclusivity_group": {
+                    "type": "string",
+                    "maxLength": 100
+                },
+                "expiry_date": {
+                    "type": "string"
+                },
+                "inactive_days": {
+                    "type": "integer",
+                    "minimum": 0
+                },
+                "max_discount_amount": {
+                    "type": "number",
+                    "minimum": 0
+                },
+                "max_total_redemptions": {
+                    "type": "integer",
+                    "minimum": 0
+                },
+                "max_usage_per_user": {
+                    "type": "integer"
+                },
+                "min_order_value": {
+                    "type": "number",
+                    "minimum": 0
+                },
+                "order_condition": {
+                    "type": "string",
+                    "enum": [
+                        "first_order",
+                        "nth_order",
+                        "inactive_days"
+                    ]
+                },
+                "order_number": {
+                    "type": "integer",
+                    "minimum": 0
+                },
+                "personal": {
+                    "type": "boolean"
+                },
+                "priority": {
+                    "type": "integer"
+                },
+                "schedules": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.CouponSchedule"
+                    }
+                },
+                "stackable": {
+                    "type": "boolean"
+                },
+                "terms_and_conditions": {
+                    "type": "string"
+                },
+                "total_budget": {
+                    "type": "number",
+                    "minimum": 0
+                },
+                "usage_type": {
+                    "type": "string",
+                    "enum": [
+                        "one_time",
+                        "multi_use",
+                        "time_based"
+                    ]
+                },
+                "valid_from": {
+                    "type": "string"
+                },
+                "valid_until": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.CouponDetails": {
+            "type": "object",
+            "required": [
+                "applicable_categories",
+                "coupon_code",
+                "discount_target",
+                "discount_type",
+                "excluded_categories",
+                "expiry_date",
+                "usage_type",
+                "valid_from",
+                "valid_until"
+            ],
+            "properties": {
+                "applicable_categories": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "applicable_medicine_id": {
+                    "type": "array",
+                    "items": {
                         "type": "string"
                     }
                 },
+                "campaign_id": {
+                    "type": "integer"
+                },
                 "coupon_code": {
                     "type": "string",
                     "maxLength": 50,
                     "minLength": 3
                 },
-                "discount_Target": {
+                "discount_target": {
                     "type": "string",
                     "enum": [
                         "inventory",
@@ -268,29 +2827,96 @@ const docTemplate = `{
                         "inventory_and_charges"
                     ]
                 },
-                "discount_type": {
+                "discount_type": {
+                    "type": "string",
+                    "enum": [
+                        "flat",
+                        "percentage",
+                        "free_delivery"
+                    ]
+                },
+                "discount_value": {
+                    "type": "number",
+                    "minimum": 0
+                },
+                "excluded_categories": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "excluded_medicine_id": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "exclusivity_group": {
+                    "type": "string",
+                    "maxLength": 100
+                },
+                "expiry_date": {
+                    "type": "string"
+                },
+                "inactive_days": {
+                    "type": "integer",
+                    "minimum": 0
+                },
+                "is_active": {
+                    "type": "boolean"
+                },
+                "is_template": {
+                    "type": "boolean"
+                },
+                "max_discount_amount": {
+                    "type": "number",
+                    "minimum": 0
+                },
+                "max_total_redemptions": {
+                    "type": "integer",
+                    "minimum": 0
+                },
+                "max_usage_per_user": {
+                    "type": "integer"
+                },
+                "min_order_value": {
+                    "type": "number",
+                    "minimum": 0
+                },
+                "order_condition": {
                     "type": "string",
                     "enum": [
-                        "flat",
-                        "percentage"
+                        "first_order",
+                        "nth_order",
+                        "inactive_days"
                     ]
                 },
-                "discount_value": {
-                    "type": "number"
+                "order_number": {
+                    "type": "integer",
+                    "minimum": 0
                 },
-                "expiry_date": {
-                    "type": "string"
+                "personal": {
+                    "type": "boolean"
                 },
-                "max_usage_per_user": {
+                "priority": {
                     "type": "integer"
                 },
-                "min_order_value": {
-                    "type": "number",
-                    "minimum": 0
+                "schedules": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.CouponSchedule"
+                    }
+                },
+                "stackable": {
+                    "type": "boolean"
                 },
                 "terms_and_conditions": {
                     "type": "string"
                 },
+                "total_budget": {
+                    "type": "number",
+                    "minimum": 0
+                },
                 "usage_type": {
                     "type": "string",
                     "enum": [
@@ -304,6 +2930,198 @@ const docTemplate = `{
                 },
                 "valid_until": {
                     "type": "string"
+                },
+                "version": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.CouponMedicinesRequest": {
+            "type": "object",
+            "required": [
+                "medicine_ids"
+            ],
+            "properties": {
+                "medicine_ids": {
+                    "type": "array",
+                    "minItems": 1,
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "main.CouponRejection": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "type": "string",
+                    "example": "BELOW_MIN_ORDER"
+                },
+                "message": {
+                    "type": "string",
+                    "example": "Add ₹20.00 more to unlock this coupon"
+                },
+                "shortfall": {
+                    "description": "Shortfall is how much more the cart needs to reach min_order_value, set for BELOW_MIN_ORDER",
+                    "type": "number",
+                    "example": 20
+                }
+            }
+        },
+        "main.CouponSchedule": {
+            "type": "object",
+            "properties": {
+                "days_of_month": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                },
+                "days_of_week": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                },
+                "end_time": {
+                    "type": "string",
+                    "example": "22:00"
+                },
+                "start_time": {
+                    "type": "string",
+                    "example": "18:00"
+                }
+            }
+        },
+        "main.CouponUsersRequest": {
+            "type": "object",
+            "required": [
+                "user_ids"
+            ],
+            "properties": {
+                "user_ids": {
+                    "type": "array",
+                    "maxItems": 100000,
+                    "minItems": 1,
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "main.CreateCampaignRequest": {
+            "type": "object",
+            "required": [
+                "count",
+                "name",
+                "template_code"
+            ],
+            "properties": {
+                "alphabet": {
+                    "type": "string",
+                    "maxLength": 64,
+                    "minLength": 2
+                },
+                "count": {
+                    "type": "integer",
+                    "maximum": 100000,
+                    "minimum": 1
+                },
+                "length": {
+                    "type": "integer",
+                    "maximum": 30,
+                    "minimum": 4
+                },
+                "name": {
+                    "type": "string",
+                    "maxLength": 255
+                },
+                "prefix": {
+                    "type": "string",
+                    "maxLength": 20
+                },
+                "template_code": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.CreateCategoryRequest": {
+            "type": "object",
+            "required": [
+                "name"
+            ],
+            "properties": {
+                "name": {
+                    "type": "string",
+                    "maxLength": 100
+                },
+                "parent": {
+                    "type": "string",
+                    "maxLength": 100
+                }
+            }
+        },
+        "main.CreateCohortRequest": {
+            "type": "object",
+            "required": [
+                "name",
+                "user_ids"
+            ],
+            "properties": {
+                "name": {
+                    "type": "string",
+                    "maxLength": 255
+                },
+                "user_ids": {
+                    "type": "array",
+                    "maxItems": 100000,
+                    "minItems": 1,
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "main.ExplainCouponsRequest": {
+            "type": "object",
+            "properties": {
+                "cart_items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Medicine"
+                    }
+                },
+                "charges": {
+                    "$ref": "#/definitions/main.OrderCharges"
+                },
+                "coupon_codes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "order_total": {
+                    "type": "number"
+                },
+                "timestamp": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.GenerateCodesRequest": {
+            "type": "object",
+            "required": [
+                "count"
+            ],
+            "properties": {
+                "count": {
+                    "type": "integer",
+                    "maximum": 100000,
+                    "minimum": 1
                 }
             }
         },
@@ -321,40 +3139,190 @@ const docTemplate = `{
                 },
                 "price": {
                     "type": "number"
+                },
+                "quantity": {
+                    "type": "integer"
                 }
             }
         },
-        "main.OrderInput": {
+        "main.MoveCategoryRequest": {
             "type": "object",
             "properties": {
-                "cart_items": {
+                "parent": {
+                    "type": "string",
+                    "maxLength": 100
+                }
+            }
+        },
+        "main.OrderCharges": {
+            "type": "object",
+            "properties": {
+                "cold_chain_handling": {
+                    "type": "number",
+                    "minimum": 0
+                },
+                "delivery": {
+                    "type": "number",
+                    "minimum": 0
+                },
+                "packaging": {
+                    "type": "number",
+                    "minimum": 0
+                },
+                "platform_fee": {
+                    "type": "number",
+                    "minimum": 0
+                }
+            }
+        },
+        "main.Problem": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "type": "string",
+                    "example": "COUPON_EXPIRED"
+                },
+                "coupon_codes": {
+                    "description": "CouponCodes are the coupons the error is about, set for ALREADY_RESERVED",
                     "type": "array",
                     "items": {
-                        "$ref": "#/definitions/main.Medicine"
+                        "type": "string"
                     }
                 },
-                "order_total": {
-                    "type": "number"
+                "detail": {
+                    "type": "string",
+                    "example": "Coupon expired or not applicable"
                 },
-                "timestamp": {
+                "instance": {
+                    "type": "string",
+                    "example": "/coupon/validate"
+                },
+                "medicine_ids": {
+                    "description": "MedicineIDs are the cart items that could not be priced, set for INVALID_CART",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "pricing": {
+                    "description": "Pricing is the repriced cart, set for PRICE_MISMATCH",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/main.CartPricing"
+                        }
+                    ]
+                },
+                "reasons": {
+                    "description": "Reasons are all the rules an invalid coupon failed",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.CouponRejection"
+                    }
+                },
+                "status": {
+                    "type": "integer",
+                    "example": 400
+                },
+                "title": {
+                    "type": "string",
+                    "example": "Bad Request"
+                },
+                "type": {
+                    "type": "string",
+                    "example": "about:blank"
+                },
+                "validation_errors": {
+                    "description": "ValidationErrors is the rule every invalid field failed, set for VALIDATION_FAILED and negative charges",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "main.RecordOrderRequest": {
+            "type": "object",
+            "required": [
+                "order_id",
+                "user_id"
+            ],
+            "properties": {
+                "order_id": {
+                    "type": "string",
+                    "maxLength": 100
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.ReservationActionRequest": {
+            "type": "object",
+            "properties": {
+                "order_id": {
                     "type": "string"
                 }
             }
         },
-        "main.UpdateCouponRequest": {
+        "main.ReserveCouponRequest": {
             "type": "object",
             "properties": {
+                "cart_items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.Medicine"
+                    }
+                },
+                "charges": {
+                    "$ref": "#/definitions/main.OrderCharges"
+                },
                 "coupon_code": {
                     "type": "string"
                 },
-                "discount_type": {
+                "coupon_codes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "order_id": {
                     "type": "string"
                 },
-                "discount_value": {
+                "order_total": {
                     "type": "number"
                 },
-                "max_usage_per_user": {
+                "timestamp": {
+                    "type": "string"
+                },
+                "ttl_seconds": {
                     "type": "integer"
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.ReverseRedemptionRequest": {
+            "type": "object",
+            "required": [
+                "order_id"
+            ],
+            "properties": {
+                "amount": {
+                    "type": "number",
+                    "minimum": 0
+                },
+                "coupon_code": {
+                    "type": "string",
+                    "maxLength": 100
+                },
+                "order_id": {
+                    "type": "string",
+                    "maxLength": 100
+                },
+                "reason": {
+                    "type": "string",
+                    "maxLength": 255
                 }
             }
         },
@@ -367,6 +3335,9 @@ const docTemplate = `{
                         "$ref": "#/definitions/main.Medicine"
                     }
                 },
+                "charges": {
+                    "$ref": "#/definitions/main.OrderCharges"
+                },
                 "coupon_code": {
                     "type": "string"
                 },
@@ -391,7 +3362,7 @@ var SwaggerInfo = &swag.Spec{
 	BasePath:         "/",
 	Schemes:          []string{},
 	Title:            "Farmako Coupon API",
-	Description:      "API for managing medicine coupons and discounts",
+	Description:      "API for managing medicine coupons and discounts.\nEvery error is returned as an RFC 7807 application/problem+json body with a stable machine-readable code.",
 	InfoInstanceName: "swagger",
 	SwaggerTemplate:  docTemplate,
 	LeftDelim:        "{{",
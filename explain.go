@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Reason codes of a CouponRejection. They are part of the API, clients match on them.
+const (
+	reasonInactive         = "COUPON_INACTIVE"
+	reasonCampaignTemplate = "CAMPAIGN_TEMPLATE"
+	reasonNotAssigned      = "NOT_ASSIGNED"
+	reasonExpired          = "COUPON_EXPIRED"
+	reasonNotYetValid      = "COUPON_NOT_YET_VALID"
+	reasonOutsideSchedule  = "OUTSIDE_SCHEDULE"
+	reasonUsageLimit       = "USAGE_LIMIT"
+	reasonNotFirstOrder    = "NOT_FIRST_ORDER"
+	reasonNotNthOrder      = "NOT_NTH_ORDER"
+	reasonRecentOrder      = "RECENT_ORDER"
+	reasonBelowMinOrder    = "BELOW_MIN_ORDER"
+	reasonNoEligibleItems  = "NO_ELIGIBLE_ITEMS"
+	reasonRedemptionLimit  = "REDEMPTION_LIMIT"
+	reasonBudgetExhausted  = "BUDGET_EXHAUSTED"
+)
+
+// CouponRejection is one validate rule a coupon failed for an order
+type CouponRejection struct {
+	Code    string `json:"code" example:"BELOW_MIN_ORDER"`
+	Message string `json:"message" example:"Add ₹20.00 more to unlock this coupon"`
+
+	// Shortfall is how much more the cart needs to reach min_order_value, set for BELOW_MIN_ORDER
+	Shortfall float64 `json:"shortfall,omitempty" example:"20"`
+}
+
+// ExplainCouponsRequest is used in /coupon/explain
+type ExplainCouponsRequest struct {
+	UserID      uuid.UUID `json:"user_id"`
+	CouponCodes []string  `json:"coupon_codes"`
+	OrderInput
+}
+
+// CouponExplanation is whether a coupon applies to the order and every rule it failed when it doesn't
+type CouponExplanation struct {
+	CouponCode string            `json:"coupon_code"`
+	Applicable bool              `json:"applicable"`
+	Savings    float64           `json:"savings"`
+	Reasons    []CouponRejection `json:"reasons"`
+}
+
+// belowMinOrder builds the BELOW_MIN_ORDER rejection with what is missing from the cart
+func belowMinOrder(coupon CouponData, orderTotal float64) CouponRejection {
+	shortfall := coupon.MinOrderValue - orderTotal
+	return CouponRejection{
+		Code:      reasonBelowMinOrder,
+		Message:   fmt.Sprintf("Add ₹%.2f more to unlock this coupon", shortfall),
+		Shortfall: shortfall,
+	}
+}
+
+// allCouponCodes returns the code of every coupon, campaign codes and personal coupons of other users aside
+func allCouponCodes(ctx context.Context, q querier, userID uuid.UUID) ([]string, error) {
+	rows, _ := q.Query(ctx, `SELECT c.coupon_code FROM coupon c
+		WHERE c.campaign_id IS NULL AND `+availableToUser(1)+`
+		ORDER BY c.coupon_code`, userID)
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// ExplainCoupons godoc
+// @Summary Explain which coupons apply to a cart
+// @Description Runs every validate rule of each coupon against the cart for the user and lists all the rules a coupon failed with a stable reason code. BELOW_MIN_ORDER carries the shortfall. Without coupon_codes every coupon is explained
+// @Tags Coupons
+// @Accept json
+// @Produce json
+// @Param request body ExplainCouponsRequest true "Cart, user and optional coupon codes"
+// @Success 200 {object} map[string]interface{} "Explanation per coupon"
+// @Failure 400 {object} Problem "Bad request"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Router /coupon/explain [post]
+func explainCouponsHandler(c *fiber.Ctx, connPool *pgxpool.Pool, cache *ristretto.Cache) error {
+	var req ExplainCouponsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if req.UserID == uuid.Nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "user_id is required")
+	}
+	if err := validateCharges(req.Charges); err != nil {
+		return err
+	}
+
+	ctx := c.Context()
+	var pricing CartPricing
+	var err error
+	req.OrderInput, pricing, err = priceCart(ctx, connPool, cache, req.OrderInput)
+	if err != nil {
+		return pricingError(err)
+	}
+
+	codes := uniqueCouponCodes(req.CouponCodes)
+	if len(codes) == 0 {
+		codes, err = allCouponCodes(ctx, connPool, req.UserID)
+		if err != nil {
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupons")
+		}
+	}
+
+	explanations := []CouponExplanation{}
+	for _, code := range codes {
+		coupon, err := loadCoupon(ctx, connPool, code)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return newProblem(fiber.StatusNotFound, codeCouponNotFound, fmt.Sprintf("Coupon %s not found", code))
+		}
+		if err != nil {
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon")
+		}
+
+		evaluation, err := evaluateCoupon(ctx, connPool, coupon, ValidateCoupon{
+			UserID:     req.UserID,
+			CouponCode: code,
+			OrderInput: req.OrderInput,
+		})
+		if err != nil {
+			fmt.Printf("Error evaluating coupon %s: %v\n", code, err)
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to evaluate coupon")
+		}
+
+		explanation := CouponExplanation{
+			CouponCode: code,
+			Applicable: evaluation.IsValid,
+			Savings:    evaluation.ItemsDiscount + evaluation.ChargesDiscount,
+			Reasons:    evaluation.Rejections,
+		}
+		if explanation.Reasons == nil {
+			explanation.Reasons = []CouponRejection{}
+		}
+		explanations = append(explanations, explanation)
+	}
+
+	return c.JSON(fiber.Map{
+		"coupons": explanations,
+		"pricing": pricing,
+	})
+}
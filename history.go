@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// adminUserHeader names the admin making a change, it is recorded in the coupon history
+const adminUserHeader = "X-Admin-User"
+
+// Actions recorded in the coupon history
+const (
+	versionCreated         = "created"
+	versionUpdated         = "updated"
+	versionDeactivated     = "deactivated"
+	versionReactivated     = "reactivated"
+	versionDeleted         = "deleted"
+	versionMedicinesAdded  = "medicines_added"
+	versionMedicineRemoved = "medicine_removed"
+	versionCategoriesAdded = "categories_added"
+	versionCategoryRemoved = "category_removed"
+	versionCampaignCreated = "campaign_created"
+	versionUsersAssigned   = "users_assigned"
+	versionUserRevoked     = "user_revoked"
+	versionCohortsAssigned = "cohorts_assigned"
+	versionCohortRevoked   = "cohort_revoked"
+)
+
+// FieldChange is the value of a coupon field before and after a change
+type FieldChange struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// CouponVersion is one entry of a coupon's history. Snapshot is the coupon as it was after the change,
+// or right before it was deleted.
+type CouponVersion struct {
+	CouponCode string                 `json:"coupon_code"`
+	Version    int                    `json:"version"`
+	Action     string                 `json:"action"`
+	ChangedBy  string                 `json:"changed_by"`
+	ChangedAt  time.Time              `json:"changed_at"`
+	Changes    map[string]FieldChange `json:"changes"`
+	Snapshot   map[string]any         `json:"snapshot"`
+}
+
+// adminUser is who the history records as making the request's change
+func adminUser(c *fiber.Ctx) string {
+	if user := c.Get(adminUserHeader); user != "" {
+		return user
+	}
+	return "unknown"
+}
+
+// couponSnapshot is the coupon as the admin API returns it, as a JSON object. It is taken before the
+// coupon is changed so the change can be compared against it.
+func couponSnapshot(ctx context.Context, q querier, couponCode string) (map[string]any, error) {
+	coupon, err := loadCoupon(ctx, q, couponCode)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(couponDetails(coupon))
+	if err != nil {
+		return nil, err
+	}
+	var snapshot map[string]any
+	err = json.Unmarshal(body, &snapshot)
+	return snapshot, err
+}
+
+// diffSnapshots lists the fields whose value differs between two snapshots, the version excepted
+func diffSnapshots(before, after map[string]any) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+	for field, value := range after {
+		if field != "version" && !reflect.DeepEqual(before[field], value) {
+			changes[field] = FieldChange{Before: before[field], After: value}
+		}
+	}
+	for field, value := range before {
+		if _, ok := after[field]; !ok {
+			changes[field] = FieldChange{Before: value}
+		}
+	}
+	return changes
+}
+
+// recordCouponVersion appends the change the transaction made to the coupon to its history and bumps
+// the coupon's version. before is the snapshot taken ahead of the change, nil for a new coupon.
+// A change that left the coupon as it was is not recorded.
+func recordCouponVersion(ctx context.Context, tx pgx.Tx, couponCode, action, changedBy string, before map[string]any) error {
+	after, err := couponSnapshot(ctx, tx, couponCode)
+	if err != nil {
+		return err
+	}
+
+	// A coupon created again under the code of a deleted one carries on from the old history
+	var changes map[string]FieldChange
+	query := `UPDATE coupon SET version = (SELECT COALESCE(max(version), 0) + 1 FROM coupon_version WHERE coupon_code = $1)
+		WHERE coupon_code = $1 RETURNING version`
+	if before != nil {
+		changes = diffSnapshots(before, after)
+		if len(changes) == 0 {
+			return nil
+		}
+		query = `UPDATE coupon SET version = version + 1 WHERE coupon_code = $1 RETURNING version`
+	}
+
+	var version int
+	if err := tx.QueryRow(ctx, query, couponCode).Scan(&version); err != nil {
+		return err
+	}
+	after["version"] = version
+	return insertCouponVersion(ctx, tx, couponCode, version, action, changedBy, changes, after)
+}
+
+// recordCouponDeletion appends the deletion of the coupon to its history, with the snapshot taken
+// right before it was deleted
+func recordCouponDeletion(ctx context.Context, tx pgx.Tx, couponCode, changedBy string, before map[string]any) error {
+	version, _ := before["version"].(float64)
+	return insertCouponVersion(ctx, tx, couponCode, int(version)+1, versionDeleted, changedBy, nil, before)
+}
+
+func insertCouponVersion(ctx context.Context, tx pgx.Tx, couponCode string, version int, action, changedBy string, changes map[string]FieldChange, snapshot map[string]any) error {
+	_, err := tx.Exec(ctx, `INSERT INTO coupon_version (coupon_code, version, action, changed_by, changes, snapshot)
+		VALUES ($1, $2, $3, $4, $5, $6)`, couponCode, version, action, changedBy, changes, snapshot)
+	return err
+}
+
+// changeCoupon runs the change to the coupon of the path in a transaction and records it in the history.
+// The coupon is locked so concurrent changes are recorded one after the other.
+func changeCoupon(c *fiber.Ctx, connPool *pgxpool.Pool, action string, change func(ctx context.Context, tx pgx.Tx, code string) error) error {
+	code := c.Params("code")
+	ctx := c.Context()
+	tx, err := connPool.Begin(ctx)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM coupon WHERE coupon_code = $1 FOR UPDATE`, code); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to lock coupon")
+	}
+	before, err := couponSnapshot(ctx, tx, code)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeCouponNotFound, "Coupon not found")
+	}
+	if err != nil {
+		fmt.Printf("Error fetching coupon: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon")
+	}
+
+	if err := change(ctx, tx, code); err != nil {
+		var problem *Problem
+		if errors.As(err, &problem) {
+			return problem
+		}
+		return databaseProblem(err)
+	}
+	if err := recordCouponVersion(ctx, tx, code, action, adminUser(c), before); err != nil {
+		return databaseProblem(err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
+	}
+	return nil
+}
+
+// CouponHistory godoc
+// @Summary Get a coupon's version history
+// @Description Lists every change made to the coupon, newest first, with who made it, when and the fields' values before and after. The history of a deleted coupon is kept
+// @Tags Admin
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Success 200 {object} map[string]interface{} "Versions"
+// @Failure 404 {object} Problem "Coupon has no history"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code}/history [get]
+func couponHistoryHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	rows, _ := connPool.Query(c.Context(), `SELECT coupon_code, version, action, changed_by, changed_at,
+		COALESCE(changes, '{}'::jsonb), snapshot
+		FROM coupon_version WHERE coupon_code = $1
+		ORDER BY version DESC`, c.Params("code"))
+	versions, err := pgx.CollectRows(rows, pgx.RowToStructByPos[CouponVersion])
+	if err != nil {
+		fmt.Printf("Error fetching coupon history: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon history")
+	}
+	if len(versions) == 0 {
+		return newProblem(fiber.StatusNotFound, codeCouponNotFound, "Coupon has no history")
+	}
+
+	return c.JSON(fiber.Map{
+		"coupon_code": c.Params("code"),
+		"versions":    versions,
+	})
+}
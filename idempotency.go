@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// idempotencyKeyHeader is the request header checkout sends so its retries are not applied twice
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyKeyRetention is how long a stored response is replayed before the key can be reused
+const idempotencyKeyRetention = 24 * time.Hour
+
+// idempotencyKeyLease is how long a request holds its key. A key still in flight after the lease
+// belongs to a request that crashed, and a retry takes it over instead of getting 409 until the sweep.
+const idempotencyKeyLease = time.Minute
+
+// idempotencyMiddleware stores the first response for every Idempotency-Key and replays it for
+// retries with the same body. A key reused with a different body is rejected.
+// Requests without the header are passed through untouched.
+func idempotencyMiddleware(connPool *pgxpool.Pool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(idempotencyKeyHeader)
+		if key == "" {
+			return c.Next()
+		}
+		if len(key) > 255 {
+			return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Idempotency-Key must be at most 255 characters")
+		}
+
+		// The fingerprint covers the method, path and raw body so the same key can't be replayed
+		// for a different request
+		sum := sha256.Sum256([]byte(c.Method() + " " + c.Path() + "\n" + string(c.Body())))
+		fingerprint := hex.EncodeToString(sum[:])
+		endpoint := c.Path()
+		ctx := c.Context()
+
+		// The key is claimed when it is new, or when the request that claimed it stored no response
+		// before its lease ran out. The lease token marks which request holds the key, so a request
+		// whose key was taken over can't drop or overwrite it.
+		leaseToken := uuid.New()
+		tag, err := connPool.Exec(ctx, `INSERT INTO idempotency_key (idempotency_key, endpoint, request_hash, locked_until, lease_token)
+			VALUES ($1, $2, $3, now() + make_interval(secs => $4), $5)
+			ON CONFLICT (idempotency_key, endpoint) DO UPDATE SET locked_until = EXCLUDED.locked_until, lease_token = EXCLUDED.lease_token
+			WHERE idempotency_key.status_code IS NULL AND idempotency_key.locked_until <= now()
+			AND idempotency_key.request_hash = EXCLUDED.request_hash`,
+			key, endpoint, fingerprint, idempotencyKeyLease.Seconds(), leaseToken)
+		if err != nil {
+			fmt.Printf("Error storing idempotency key: %v\n", err)
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to store idempotency key")
+		}
+
+		if tag.RowsAffected() == 0 {
+			var storedHash string
+			var statusCode *int
+			var responseBody []byte
+			var contentType *string
+			err := connPool.QueryRow(ctx, `SELECT request_hash, status_code, response_body, content_type
+				FROM idempotency_key WHERE idempotency_key = $1 AND endpoint = $2`, key, endpoint).
+				Scan(&storedHash, &statusCode, &responseBody, &contentType)
+			if err != nil {
+				return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch idempotency key")
+			}
+			if storedHash != fingerprint {
+				return newProblem(fiber.StatusUnprocessableEntity, codeIdempotencyKeyReused,
+					"Idempotency-Key was already used with a different request body")
+			}
+			if statusCode == nil {
+				return newProblem(fiber.StatusConflict, codeRequestInProgress,
+					"A request with this Idempotency-Key is still being processed")
+			}
+
+			c.Set("Idempotent-Replayed", "true")
+			if contentType != nil {
+				c.Set(fiber.HeaderContentType, *contentType)
+			}
+			return c.Status(*statusCode).Send(responseBody)
+		}
+
+		// Keys whose request failed on our side are dropped so the retry runs the handler again
+		forget := func() {
+			if _, err := connPool.Exec(ctx, `DELETE FROM idempotency_key
+				WHERE idempotency_key = $1 AND endpoint = $2 AND lease_token = $3`, key, endpoint, leaseToken); err != nil {
+				fmt.Printf("Error removing idempotency key: %v\n", err)
+			}
+		}
+
+		// A panicking handler never stores its response, its key is dropped before the panic goes on
+		defer func() {
+			if r := recover(); r != nil {
+				forget()
+				panic(r)
+			}
+		}()
+
+		// Errors are rendered as problems here rather than by the app, so a 4xx problem is stored
+		// and replayed like any other response
+		if err := c.Next(); err != nil {
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				forget()
+				return err
+			}
+		}
+
+		statusCode := c.Response().StatusCode()
+		if statusCode >= fiber.StatusInternalServerError {
+			forget()
+			return nil
+		}
+
+		_, err = connPool.Exec(ctx, `UPDATE idempotency_key SET status_code = $3, response_body = $4, content_type = $5
+			WHERE idempotency_key = $1 AND endpoint = $2 AND lease_token = $6`,
+			key, endpoint, statusCode, c.Response().Body(), string(c.Response().Header.ContentType()), leaseToken)
+		if err != nil {
+			fmt.Printf("Error storing idempotent response: %v\n", err)
+		}
+		return nil
+	}
+}
+
+// sweepIdempotencyKeys periodically removes keys older than the retention window
+func sweepIdempotencyKeys(ctx context.Context, connPool *pgxpool.Pool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := connPool.Exec(ctx, `DELETE FROM idempotency_key WHERE created_at < now() - make_interval(secs => $1)`,
+				idempotencyKeyRetention.Seconds())
+			if err != nil {
+				log.Printf("idempotency key sweep failed: %v", err)
+			}
+		}
+	}
+}
@@ -2,12 +2,23 @@ CREATE TABLE medicine (
     id UUID PRIMARY KEY,
     name VARCHAR(255) NOT NULL,
     category VARCHAR(100) NOT NULL,
-    price FLOAT NOT NULL
+    price FLOAT NOT NULL,
+    is_active BOOLEAN NOT NULL DEFAULT true
 );
 
+-- Category tree. A coupon targeting a category covers the medicines of all its subcategories.
+CREATE TABLE category (
+    name VARCHAR(100) PRIMARY KEY,
+    parent_name VARCHAR(100) REFERENCES category(name),
+    CHECK (parent_name <> name)
+);
+
+CREATE INDEX category_parent_idx ON category (parent_name);
+
 CREATE TYPE usage_type_enum AS ENUM ('one_time', 'multi_use', 'time_based');
 CREATE TYPE discount_type_enum AS ENUM ('flat', 'percentage', 'free_delivery');
 CREATE TYPE discount_target_enum AS ENUM ('inventory', 'charges', 'inventory_and_charges');
+CREATE TYPE order_condition_enum AS ENUM ('first_order', 'nth_order', 'inactive_days');
 
 CREATE TABLE coupon (
     coupon_code VARCHAR(100) PRIMARY KEY,
@@ -20,9 +31,40 @@ CREATE TABLE coupon (
     discount_value FLOAT NOT NULL,
     discount_target discount_target_enum NOT NULL,
     terms_and_conditions VARCHAR(1000),
-    max_usage_per_user INT
+    max_usage_per_user INT,
+    stackable BOOLEAN NOT NULL DEFAULT false,
+    exclusivity_group VARCHAR(100),
+    priority INT NOT NULL DEFAULT 0,
+    max_discount_amount FLOAT,
+    max_total_redemptions INT,
+    total_budget FLOAT,
+    total_redemptions INT NOT NULL DEFAULT 0,
+    budget_used FLOAT NOT NULL DEFAULT 0,
+    is_active BOOLEAN NOT NULL DEFAULT true,
+    version INT NOT NULL DEFAULT 1,
+    is_template BOOLEAN NOT NULL DEFAULT false,
+    is_personal BOOLEAN NOT NULL DEFAULT false,
+    order_condition order_condition_enum,
+    order_number INT CHECK (order_number > 0),
+    inactive_days INT CHECK (inactive_days > 0)
 );
 
+-- Batch of single-use codes sharing the terms of a template coupon. The codes are rows of coupon with
+-- the campaign's id, they are evaluated with the template's current terms.
+CREATE TABLE coupon_campaign (
+    campaign_id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    template_code VARCHAR(100) NOT NULL REFERENCES coupon(coupon_code),
+    prefix VARCHAR(20) NOT NULL DEFAULT '',
+    code_length INT NOT NULL,
+    alphabet VARCHAR(64) NOT NULL,
+    created_by VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+ALTER TABLE coupon ADD COLUMN campaign_id INT REFERENCES coupon_campaign(campaign_id);
+CREATE INDEX coupon_campaign_idx ON coupon (campaign_id);
+
 CREATE TABLE coupon_medicine_map (
     coupon_code VARCHAR(100) REFERENCES coupon(coupon_code),
     medicine_id UUID REFERENCES medicine(id),
@@ -35,14 +77,178 @@ CREATE TABLE coupon_category_map (
     PRIMARY KEY (coupon_code, category_name)
 );
 
+-- Exclusions win over the maps: a medicine or category listed here is never discounted by the coupon
+CREATE TABLE coupon_medicine_exclusion (
+    coupon_code VARCHAR(100) REFERENCES coupon(coupon_code),
+    medicine_id UUID REFERENCES medicine(id),
+    PRIMARY KEY (coupon_code, medicine_id)
+);
+
+CREATE TABLE coupon_category_exclusion (
+    coupon_code VARCHAR(100) REFERENCES coupon(coupon_code),
+    category_name VARCHAR(100),
+    PRIMARY KEY (coupon_code, category_name)
+);
+
+-- Personal coupons are only used by the users assigned to them, directly or through a cohort
+CREATE TABLE user_cohort (
+    cohort_id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL UNIQUE,
+    created_by VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE TABLE user_cohort_member (
+    cohort_id INT REFERENCES user_cohort(cohort_id),
+    user_id UUID NOT NULL,
+    PRIMARY KEY (cohort_id, user_id)
+);
+
+CREATE INDEX user_cohort_member_user_idx ON user_cohort_member (user_id);
+
+CREATE TABLE coupon_user_assignment (
+    coupon_code VARCHAR(100) REFERENCES coupon(coupon_code),
+    user_id UUID NOT NULL,
+    assigned_by VARCHAR(255) NOT NULL,
+    assigned_at TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (coupon_code, user_id)
+);
+
+CREATE INDEX coupon_user_assignment_user_idx ON coupon_user_assignment (user_id);
+
+CREATE TABLE coupon_cohort_assignment (
+    coupon_code VARCHAR(100) REFERENCES coupon(coupon_code),
+    cohort_id INT REFERENCES user_cohort(cohort_id),
+    PRIMARY KEY (coupon_code, cohort_id)
+);
+
+CREATE TABLE coupon_schedule (
+    id SERIAL PRIMARY KEY,
+    coupon_code VARCHAR(100) NOT NULL REFERENCES coupon(coupon_code),
+    days_of_week INT[] NOT NULL DEFAULT '{}',
+    days_of_month INT[] NOT NULL DEFAULT '{}',
+    start_minute INT NOT NULL DEFAULT 0 CHECK (start_minute BETWEEN 0 AND 1440),
+    end_minute INT NOT NULL DEFAULT 1440 CHECK (end_minute BETWEEN 0 AND 1440)
+);
+
+CREATE INDEX coupon_schedule_coupon_idx ON coupon_schedule (coupon_code);
+
 CREATE TABLE coupon_usage (
   user_id UUID NOT NULL,
   coupon_code TEXT NOT NULL,
   usage INT NOT NULL DEFAULT 1,
+  window_start TIMESTAMP,
   PRIMARY KEY (user_id, coupon_code),
   FOREIGN KEY (coupon_code) REFERENCES coupon(coupon_code)
 );
 
+-- Orders placed by the users, order-history coupon conditions are checked against them. Orders
+-- redeeming a coupon are recorded on commit, the others through POST /orders.
+CREATE TABLE user_order (
+    order_id VARCHAR(100) PRIMARY KEY,
+    user_id UUID NOT NULL,
+    placed_at TIMESTAMP NOT NULL DEFAULT now(),
+    cancelled_at TIMESTAMP
+);
+
+CREATE INDEX user_order_user_idx ON user_order (user_id, placed_at);
+
+CREATE TYPE reservation_status_enum AS ENUM ('reserved', 'committed', 'released', 'expired');
+
+CREATE TABLE coupon_reservation (
+    reservation_id UUID PRIMARY KEY,
+    order_id VARCHAR(100) NOT NULL,
+    user_id UUID NOT NULL,
+    coupon_code VARCHAR(100) NOT NULL REFERENCES coupon(coupon_code),
+    coupon_version INT,
+    items_discount FLOAT NOT NULL DEFAULT 0,
+    charges_discount FLOAT NOT NULL DEFAULT 0,
+    window_start TIMESTAMP,
+    status reservation_status_enum NOT NULL DEFAULT 'reserved',
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX coupon_reservation_order_coupon_idx
+    ON coupon_reservation (order_id, coupon_code) WHERE status IN ('reserved', 'committed');
+CREATE INDEX coupon_reservation_active_idx
+    ON coupon_reservation (user_id, coupon_code) WHERE status = 'reserved';
+
+-- Ledger of the committed reservations: which order redeemed a coupon, for how much and with which
+-- version of it. Reversals give the discount back, in part for partial refunds.
+CREATE TABLE coupon_redemption (
+    redemption_id UUID PRIMARY KEY REFERENCES coupon_reservation(reservation_id),
+    order_id VARCHAR(100) NOT NULL,
+    user_id UUID NOT NULL,
+    coupon_code VARCHAR(100) NOT NULL REFERENCES coupon(coupon_code),
+    coupon_version INT,
+    items_discount FLOAT NOT NULL,
+    charges_discount FLOAT NOT NULL,
+    window_start TIMESTAMP,
+    redeemed_at TIMESTAMP NOT NULL DEFAULT now(),
+    reversed_discount FLOAT NOT NULL DEFAULT 0,
+    reversed_at TIMESTAMP
+);
+
+CREATE INDEX coupon_redemption_order_idx ON coupon_redemption (order_id);
+CREATE INDEX coupon_redemption_coupon_idx ON coupon_redemption (coupon_code, redeemed_at);
+CREATE INDEX coupon_redemption_user_idx ON coupon_redemption (user_id, redeemed_at);
+
+CREATE TABLE coupon_redemption_reversal (
+    reversal_id SERIAL PRIMARY KEY,
+    redemption_id UUID NOT NULL REFERENCES coupon_redemption(redemption_id),
+    discount FLOAT NOT NULL,
+    full_reversal BOOLEAN NOT NULL,
+    reason VARCHAR(255),
+    reversed_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+-- History of every change to a coupon and its maps. It has no foreign key so the history of a
+-- deleted coupon is kept, and rows can only be appended.
+CREATE TABLE coupon_version (
+    coupon_code VARCHAR(100) NOT NULL,
+    version INT NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    changed_by VARCHAR(255) NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT now(),
+    changes JSONB,
+    snapshot JSONB NOT NULL,
+    PRIMARY KEY (coupon_code, version)
+);
+
+CREATE FUNCTION coupon_version_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'coupon_version is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER coupon_version_append_only
+    BEFORE UPDATE OR DELETE ON coupon_version
+    FOR EACH ROW EXECUTE FUNCTION coupon_version_append_only();
+
+CREATE TABLE idempotency_key (
+    idempotency_key VARCHAR(255) NOT NULL,
+    endpoint VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    status_code INT,
+    response_body BYTEA,
+    content_type VARCHAR(100),
+    locked_until TIMESTAMP NOT NULL,
+    lease_token UUID NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (idempotency_key, endpoint)
+);
+
+INSERT INTO category (name, parent_name) VALUES
+('Pain Relief',  NULL),
+('Antibiotics',  NULL),
+('Allergy',      NULL),
+('Diabetes',     NULL),
+('Cardiac care', NULL),
+('Cholesterol',  'Cardiac care'),
+('Hypertension', 'Cardiac care');
+
 INSERT INTO medicine (id, name, category, price) VALUES
 ('3fa85f64-5717-4562-b3fc-2c963f66afa6', 'Paracetamol 500mg',  'Pain Relief',  25),
 ('7b9d71f6-0b8e-4e12-b6b3-1cd5cf9243a0', 'Amoxicillin 250mg',  'Antibiotics',  50),
@@ -72,4 +278,29 @@ INSERT INTO coupon (
 ('AMOX25',            '2025-08-01 23:59:59', 'one_time',    45,   '2025-06-01 00:00:00', '2025-08-01 23:59:59', 'flat',       25, 'One-time discount on Amoxicillin.',            1, 'inventory'),
 ('ANTIBIO10',         '2025-11-30 23:59:59', 'multi_use',   70,   '2025-04-01 00:00:00', '2025-11-30 23:59:59', 'percentage', 10, 'Save on antibiotics.',                         3, 'inventory'),
 ('LORA15',            '2025-09-01 23:59:59', 'time_based',  25,   '2025-05-01 00:00:00', '2025-09-01 23:59:59', 'flat',       15, 'Loratadine flat discount.',                    1, 'inventory'),
-('WELCOME50',         '2026-01-01 00:00:00', 'one_time',   150,   '2025-01-01 00:00:00', '2025-12-31 23:59:59', 'percentage', 20, 'First-time buyer welcome discount.',           1, 'inventory');
+('WELCOME50',         '2026-01-01 00:00:00', 'multi_use',  150,   '2025-01-01 00:00:00', '2025-12-31 23:59:59', 'percentage', 20, 'First-time buyer welcome discount.',           1, 'inventory'),
+('FREEDEL99',         '2026-01-01 00:00:00', 'multi_use',   99,   '2025-01-01 00:00:00', '2025-12-31 23:59:59', 'free_delivery', 0, 'Free delivery on orders above ₹99.',       5, 'charges');
+
+-- Category coupons apply first and the site-wide 5% stacks on the discounted amount
+UPDATE coupon SET stackable = true, exclusivity_group = 'category', priority = 10
+WHERE coupon_code IN ('PERCENT10ALLERGY', 'DIAB10', 'ANTIBIO10', 'CHOL30OFF');
+UPDATE coupon SET stackable = true, exclusivity_group = 'site_wide', priority = 0
+WHERE coupon_code = 'SAVE5ALL';
+
+-- Percentage coupons on large chronic-care orders are capped
+UPDATE coupon SET max_discount_amount = 200 WHERE coupon_code = 'WELCOME50';
+UPDATE coupon SET max_discount_amount = 100 WHERE coupon_code IN ('SAVE10', 'DIAB10', 'ANTIBIO10');
+
+-- Campaign coupons with a global redemption cap and budget. WELCOME50 is multi_use once per user, a
+-- one_time coupon could only be redeemed once whatever its cap says.
+UPDATE coupon SET max_total_redemptions = 1000, total_budget = 50000 WHERE coupon_code = 'WELCOME50';
+UPDATE coupon SET total_budget = 20000 WHERE coupon_code = 'SAVE5ALL';
+
+-- The welcome discount is only for a user's first order
+UPDATE coupon SET order_condition = 'first_order' WHERE coupon_code = 'WELCOME50';
+
+-- Recurring windows of time_based coupons, in COUPON_TIMEZONE: Loratadine happy hours on Sundays 6-10pm
+-- and the New Year offer on the first 3 days of the month
+INSERT INTO coupon_schedule (coupon_code, days_of_week, days_of_month, start_minute, end_minute) VALUES
+('LORA15',      '{0}', '{}',      1080, 1320),
+('NEWYEAR2025', '{}',  '{1,2,3}', 0,    1440);
@@ -12,21 +12,55 @@ import (
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/swagger"
 	"github.com/dgraph-io/ristretto"
+	"github.com/jackc/pgx/v5"
+	"errors"
+	"os"
+	_ "time/tzdata"
 	_ "github.com/Dharshan-K/farmakoAPI/docs"
 )
 
-//Medicine represents the Medicine data
+//Medicine represents the Medicine data. In a cart it is a line item, Quantity defaults to 1 when omitted
 type Medicine struct {
 	ID       uuid.UUID `json:"id"`
 	Name     string    `json:"name"`
 	Category string    `json:"category"`
 	Price    float64   `json:"price"`
+	Quantity int       `json:"quantity,omitempty"`
+}
+
+//LineTotal is the price of the cart line, the unit price times the quantity
+func (m Medicine) LineTotal() float64 {
+	return m.Price * float64(m.Quantity)
+}
+
+//OrderCharges represents the charges added to the order on top of the cart items
+type OrderCharges struct {
+	Delivery          float64 `json:"delivery" validate:"gte=0"`
+	Packaging         float64 `json:"packaging" validate:"gte=0"`
+	PlatformFee       float64 `json:"platform_fee" validate:"gte=0"`
+	ColdChainHandling float64 `json:"cold_chain_handling" validate:"gte=0"`
+}
+
+//validateCharges rejects negative charges, they would lower the order's total and the base of a charges discount
+func validateCharges(charges OrderCharges) error {
+	if err := validate.Struct(charges); err != nil {
+		problem := newProblem(fiber.StatusBadRequest, codeInvalidInput, "charges can't be negative")
+		problem.ValidationErrors = validationErrors(err)
+		return problem
+	}
+	return nil
+}
+
+//Total returns the sum of all the charges
+func (charges OrderCharges) Total() float64 {
+	return charges.Delivery + charges.Packaging + charges.PlatformFee + charges.ColdChainHandling
 }
 
 //OrderInput represents the Order Input given to a API
 type OrderInput struct {
 	CartItems  []Medicine `json:"cart_items"`
 	OrderTotal float64   `json:"order_total"`
+	Charges    OrderCharges `json:"charges"`
 	Timestamp  time.Time `json:"timestamp"`
 }
 
@@ -34,6 +68,14 @@ type OrderInput struct {
 type ApplicableCoupon struct {
 	CouponCode    string  `json:"coupon_code"`
 	DiscountValue float64 `json:"discount_value"`
+	CapApplied    bool    `json:"cap_applied"`
+	Condition     string  `json:"condition,omitempty"`
+}
+
+// ApplicableCouponsRequest is used in /coupon/applicable, personal coupons are only listed for the users they are assigned to
+type ApplicableCouponsRequest struct {
+	UserID uuid.UUID `json:"user_id"`
+	OrderInput
 }
 
 // ValidateCoupon is used in /coupon/validate
@@ -42,13 +84,8 @@ type ValidateCoupon struct {
 	CouponCode string `json:"coupon_code"`
 	OrderInput
 }
-//UpdateCouponRequest is for update info of a coupon
-type UpdateCouponRequest struct {
-	CouponCode string `json:"coupon_code"`
-	DiscountType string `json:"discount_type"`
-	DiscountValue float64 `json:"discount_value"`
-	MaxUsagePerUser int `json:"max_usage_per_user"`
-}
+//validate checks the validate tags of the admin request bodies
+var validate = validator.New()
 
 //CouponUsageCache is a cache to track coupon usage
 type CouponUsageCache struct {
@@ -60,17 +97,45 @@ type CouponUsageCache struct {
 type CouponData struct {
 	CouponCode string `json:"coupon_code" validate:"required,min=3,max=50"`
 	ExpiryDate time.Time `json:"expiry_date" validate:"required"`
-	ApplicableMedicineId []string `json:"applicable_medicine_id" validate="dive,uuid4"`
-	ApplicableCategories []string `json:"applicable_categories" validate="dive,required"`
+	ApplicableMedicineId []string `json:"applicable_medicine_id" validate:"dive,uuid"`
+	ApplicableCategories []string `json:"applicable_categories" validate:"dive,required"`
+	ExcludedMedicineId []string `json:"excluded_medicine_id" validate:"dive,uuid"`
+	ExcludedCategories []string `json:"excluded_categories" validate:"dive,required"`
 	UsageType string `json:"usage_type" validate:"required,oneof=one_time multi_use time_based"`
 	MinOrderValue float64 `json:"min_order_value" validate:"gte=0"`
 	ValidFrom time.Time `json:"valid_from" validate:"required"`
 	ValidUntil time.Time `json:"valid_until" validate:"required,gtfield=ValidFrom"`
 	TermsAndConditions string `json:"terms_and_conditions"`
-	DiscountType string `json:"discount_type" validate:"required,oneof=flat percentage"`
-	DiscountValue float64 `json:"discount_value" validate:"gt=0,lt=100"`
+	DiscountType string `json:"discount_type" validate:"required,oneof=flat percentage free_delivery"`
+	DiscountValue float64 `json:"discount_value" validate:"required_unless=DiscountType free_delivery,gte=0,lt=100"`
 	DiscountTarget string `json:"discount_target" validate:"required,oneof=inventory charges inventory_and_charges"`
 	MaxUsagePerUser int `json:"max_usage_per_user" validate:"gt=0"`
+	Stackable bool `json:"stackable"`
+	ExclusivityGroup string `json:"exclusivity_group" validate:"max=100"`
+	Priority int `json:"priority"`
+	MaxDiscountAmount float64 `json:"max_discount_amount" validate:"excluded_unless=DiscountType percentage,gte=0"`
+	MaxTotalRedemptions int `json:"max_total_redemptions" validate:"gte=0"`
+	TotalBudget float64 `json:"total_budget" validate:"gte=0"`
+	Schedules []CouponSchedule `json:"schedules" validate:"excluded_unless=UsageType time_based,dive"`
+	Personal bool `json:"personal"`
+	OrderCondition string `json:"order_condition" validate:"omitempty,oneof=first_order nth_order inactive_days"`
+	OrderNumber int `json:"order_number" validate:"required_if=OrderCondition nth_order,excluded_unless=OrderCondition nth_order,gte=0"`
+	InactiveDays int `json:"inactive_days" validate:"required_if=OrderCondition inactive_days,excluded_unless=OrderCondition inactive_days,gte=0"`
+
+	// inactive is set on coupons an admin has deactivated
+	inactive bool
+
+	// version is bumped on every change to the coupon, see coupon_version
+	version int
+
+	// template is set on coupons campaign codes are generated from, campaignID on the campaign codes
+	template   bool
+	campaignID *int
+
+	// templateCode is the template of a campaign code, its redemption cap, budget and campaignUserLimit
+	// per user apply across all of the template's codes
+	templateCode      string
+	campaignUserLimit int
 }
 
 // AddCoupon godoc
@@ -81,31 +146,23 @@ type CouponData struct {
 // @Produce json
 // @Param coupon body CouponData true "Coupon data"
 // @Success 200 {string} string "Coupon added successfully"
-// @Failure 400 {object} map[string]interface{} "Validation errors"
-// @Failure 500 {object} map[string]interface{} "Internal server error"
+// @Failure 400 {object} Problem "Validation errors"
+// @Failure 409 {object} Problem "Coupon code already exists"
+// @Failure 500 {object} Problem "Internal server error"
 // @Security ApiKeyAuth
 // @Router /admin/addCoupons [post]
 func addCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
 	var couponData CouponData;
-	var validate = validator.New()
 
 	// Parses the request body
 	if err := c.BodyParser(&couponData); err != nil {
 		fmt.Println("Invalid request body")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error" : err,
-		})
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, err.Error())
 	}
 
 	//Uses the validator to validate the provided constraints
-	if err:= validate.Struct(couponData); err != nil {
-		errors := make(map[string]string)
-		for _,err := range err.(validator.ValidationErrors) {
-			errors[err.Field()] = fmt.Sprintf("failed on '%s' validation.", err.Tag())
-		}
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"validation_errors" : errors,
-		})
+	if problem := checkCouponData(couponData); problem != nil {
+		return problem
 	}
 
 	// My architecture maintains two tables as maps coupon_category_map and coupon_medicine_map to store the arrays 
@@ -114,7 +171,7 @@ func addCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
 	tx, err := connPool.Begin(ctx)
 	if err !=nil {
 		fmt.Printf("Error starting transaction: %v\n", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "could not start transaction","message" : "Transaction error"})
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "could not start transaction")
 	}
 	defer tx.Rollback(ctx)
 	_, err = tx.Exec(ctx, `INSERT INTO coupon(coupon_code,
@@ -127,41 +184,34 @@ func addCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
 		discount_value,
 		max_usage_per_user,
 		terms_and_conditions,
-		discount_target
-	)VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)`, couponData.CouponCode, couponData.ExpiryDate, couponData.UsageType, couponData.MinOrderValue, couponData.ValidFrom, couponData.ValidUntil, couponData.DiscountType, couponData.DiscountValue, couponData.MaxUsagePerUser, couponData.TermsAndConditions, couponData.DiscountTarget)
+		discount_target,
+		stackable,
+		exclusivity_group,
+		priority,
+		max_discount_amount,
+		max_total_redemptions,
+		total_budget,
+		is_personal,
+		order_condition,
+		order_number,
+		inactive_days
+	)VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,NULLIF($13,''),$14,NULLIF($15,0),NULLIF($16,0),NULLIF($17,0),$18,NULLIF($19,'')::order_condition_enum,NULLIF($20,0),NULLIF($21,0))`, couponData.CouponCode, couponData.ExpiryDate, couponData.UsageType, couponData.MinOrderValue, couponData.ValidFrom, couponData.ValidUntil, couponData.DiscountType, couponData.DiscountValue, couponData.MaxUsagePerUser, couponData.TermsAndConditions, couponData.DiscountTarget, couponData.Stackable, couponData.ExclusivityGroup, couponData.Priority, couponData.MaxDiscountAmount, couponData.MaxTotalRedemptions, couponData.TotalBudget, couponData.Personal, couponData.OrderCondition, couponData.OrderNumber, couponData.InactiveDays)
 	if err != nil {
-		fmt.Println("Error: %v", err)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error" : err,
-		})
+		return databaseProblem(err)
 	}
 
-	medicineQuery := `INSERT INTO coupon_medicine_map(coupon_code, medicine_id) VALUES($1,$2)`
-	categoryQuery := `INSERT INTO coupon_category_map(coupon_code, category_name) VALUES($1,$2)`
-
-	for _,medicineID := range(couponData.ApplicableMedicineId) {
-		_, err := tx.Exec(ctx, medicineQuery, couponData.CouponCode,medicineID)
-		if err != nil {
-			fmt.Println("Error: %v", err)
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error" : err,
-			})
-		}
+	if err := insertCouponRules(ctx, tx, couponData); err != nil {
+		return databaseProblem(err)
 	}
 
-	for _, category := range(couponData.ApplicableCategories) {
-		_, err := tx.Exec(ctx, categoryQuery, couponData.CouponCode,category)
-		if err != nil {
-			fmt.Println("Error: %v", err)
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error" : err,
-			})
-		}
+	//The new coupon is the first version of its history
+	if err := recordCouponVersion(ctx, tx, couponData.CouponCode, versionCreated, adminUser(c), nil); err != nil {
+		return databaseProblem(err)
 	}
 
 	//Transaction is commited
 	if err := tx.Commit(ctx); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to commit transaction"})
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "failed to commit transaction")
 	}
 
 	return c.SendString("Coupon added successfully")
@@ -169,424 +219,317 @@ func addCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
 
 // UpdateCoupon godoc
 // @Summary Update an existing coupon
-// @Description Update coupon details
+// @Description Changes any coupon field, the coupon_code excepted. Fields left out of the body keep their value, applicable_medicine_id, applicable_categories and schedules replace the current ones when given. The result is validated with the same rules as addCoupons
 // @Tags Admin
 // @Accept json
 // @Produce json
-// @Param coupon body UpdateCouponRequest true "Coupon update data"
-// @Success 200 {object} map[string]interface{} "Success message"
-// @Failure 400 {object} map[string]interface{} "Bad request"
-// @Failure 500 {object} map[string]interface{} "Internal server error"
+// @Param code path string true "Coupon code"
+// @Param coupon body CouponData true "Fields to change"
+// @Success 200 {object} CouponDetails "Updated coupon"
+// @Failure 400 {object} Problem "Validation errors"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Failure 500 {object} Problem "Internal server error"
 // @Security ApiKeyAuth
-// @Router /coupon/update [post]	
+// @Router /admin/coupons/{code} [patch]
 func updateCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
-	var req UpdateCouponRequest
-
-	//Parses Request body
-	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Invalid input")
+	code := c.Params("code")
+	ctx := c.Context()
+	tx, err := connPool.Begin(ctx)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to start transaction")
 	}
+	defer tx.Rollback(ctx)
 
-	tx, err := connPool.Begin(c.Context())
+	//The coupon is locked so concurrent updates can't overwrite each other's fields
+	_, err = tx.Exec(ctx, `SELECT 1 FROM coupon WHERE coupon_code = $1 FOR UPDATE`, code)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Failed to start transaction")
-	}	
-
-	var couponID int
-	query := `SELECT id FROM coupon WHERE code = $1 FOR UPDATE`
-	err = tx.QueryRow(c.Context(), query, req.CouponCode).Scan(&couponID)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to lock coupon")
+	}
+	couponData, err := loadCoupon(ctx, tx, code)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeCouponNotFound, "Coupon not found")
+	}
+	if err != nil {
+		fmt.Printf("Error fetching coupon: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon")
+	}
+	if couponData.campaignID != nil {
+		return campaignCodeProblem()
+	}
+	//The history compares the update against the coupon as it was
+	before, err := couponSnapshot(ctx, tx, code)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Failed to lock coupon")
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon")
 	}
-	defer tx.Rollback(c.Context()) 
 
-	//The necessary details are updated in the coupon table
-	updateQuery := `
-		UPDATE coupon
-		SET discount_type = $1,
-				discount_value = $2,
-				max_usage_per_user = $3
-		WHERE id = $4
-	`
-	_, err = tx.Exec(c.Context(), updateQuery,
-		req.DiscountType, req.DiscountValue, req.MaxUsagePerUser, couponID)
+	//The body is parsed over the current coupon, so only the fields it carries change.
+	//Schedules are cleared first so the new ones don't inherit fields of the old ones, they are
+	//put back when the body leaves them out.
+	schedules := couponData.Schedules
+	couponData.Schedules = nil
+	if err := c.BodyParser(&couponData); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, err.Error())
+	}
+	if couponData.Schedules == nil {
+		couponData.Schedules = schedules
+	}
+	if couponData.CouponCode != code {
+		return validationProblem(map[string]string{
+			"CouponCode" : "coupon_code can't be changed.",
+		})
+	}
+
+	if problem := checkCouponData(couponData); problem != nil {
+		return problem
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE coupon SET
+		expiry_date = $2,
+		usage_type = $3,
+		min_order_value = $4,
+		valid_from = $5,
+		valid_until = $6,
+		discount_type = $7,
+		discount_value = $8,
+		max_usage_per_user = $9,
+		terms_and_conditions = $10,
+		discount_target = $11,
+		stackable = $12,
+		exclusivity_group = NULLIF($13,''),
+		priority = $14,
+		max_discount_amount = NULLIF($15,0),
+		max_total_redemptions = NULLIF($16,0),
+		total_budget = NULLIF($17,0),
+		is_personal = $18,
+		order_condition = NULLIF($19,'')::order_condition_enum,
+		order_number = NULLIF($20,0),
+		inactive_days = NULLIF($21,0)
+	WHERE coupon_code = $1`, couponData.CouponCode, couponData.ExpiryDate, couponData.UsageType, couponData.MinOrderValue, couponData.ValidFrom, couponData.ValidUntil, couponData.DiscountType, couponData.DiscountValue, couponData.MaxUsagePerUser, couponData.TermsAndConditions, couponData.DiscountTarget, couponData.Stackable, couponData.ExclusivityGroup, couponData.Priority, couponData.MaxDiscountAmount, couponData.MaxTotalRedemptions, couponData.TotalBudget, couponData.Personal, couponData.OrderCondition, couponData.OrderNumber, couponData.InactiveDays)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Update failed")
+		return databaseProblem(err)
+	}
+
+	//The maps and schedules are replaced as a whole, unchanged ones are written back as they were
+	for _, query := range []string{
+		`DELETE FROM coupon_medicine_map WHERE coupon_code = $1`,
+		`DELETE FROM coupon_category_map WHERE coupon_code = $1`,
+		`DELETE FROM coupon_medicine_exclusion WHERE coupon_code = $1`,
+		`DELETE FROM coupon_category_exclusion WHERE coupon_code = $1`,
+		`DELETE FROM coupon_schedule WHERE coupon_code = $1`,
+	} {
+		if _, err := tx.Exec(ctx, query, code); err != nil {
+			return databaseProblem(err)
+		}
+	}
+	if err := insertCouponRules(ctx, tx, couponData); err != nil {
+		return databaseProblem(err)
+	}
+	if err := recordCouponVersion(ctx, tx, code, versionUpdated, adminUser(c), before); err != nil {
+		return databaseProblem(err)
 	}
 
-	//transaction is commites
-	if err := tx.Commit(c.Context()); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Transaction commit failed")
+	//transaction is commited
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
 	}
 
-	return c.JSON(fiber.Map{
-		"message": "Coupon updated successfully",
-	})
+	return getCouponHandler(c, connPool)
 }
 
 // GetApplicableCoupons godoc
 // @Summary Get applicable coupons
-// @Description Returns coupons applicable to the provided cart items
+// @Description Returns coupons applicable to the provided cart items at the order timestamp, time_based coupons only inside their schedule windows. Discounts are calculated on the cart repriced from the medicine table. Coupons whose order-history condition the user doesn't meet are listed in not_applicable with the reason
 // @Tags Coupons
 // @Accept json
 // @Produce json
-// @Param cart body OrderInput true "Cart items"
+// @Param cart body ApplicableCouponsRequest true "Cart items and the user, personal coupons are left out without one"
 // @Success 200 {object} map[string][]ApplicableCoupon "List of applicable coupons"
-// @Failure 400 {object} map[string]interface{} "Bad request"
+// @Failure 400 {object} Problem "Bad request"
 // @Router /coupon/applicable [post]
 func getApplicableCoupons(c *fiber.Ctx, connPool *pgxpool.Pool, cache *ristretto.Cache) error {
-	var cart_details OrderInput;
+	var req ApplicableCouponsRequest;
 
 	//Parses request body
-	if err := c.BodyParser(&cart_details); err != nil {
+	if err := c.BodyParser(&req); err != nil {
 		fmt.Println("Invalid Input")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error" : err,
-		})
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, err.Error())
 	}
-
-	//creates an array to store the medicine ID
-	medicineIDs := make([]uuid.UUID, len(cart_details.CartItems))
-	for i, item := range cart_details.CartItems {
-			medicineIDs[i] = item.ID
+	if err := validateCharges(req.Charges); err != nil {
+		return err
 	}
+	cart_details := req.OrderInput
 
-	var medicines []uuid.UUID;
-	var categories []string;
-	var missingMedicineIDs []uuid.UUID
-
-	//cache is checked for medicine ID. The cache stores the details of medicines frequently accessed.
-	// if found it adds to medicines. Not found are added to missingMedicineIDs
-	for _, medID := range medicineIDs {
-		cacheKey := fmt.Sprintf("medicine:%s", medID.String())
-
-		if val, found := cache.Get(cacheKey); found {
-			med := val.(Medicine)
-			medicines = append(medicines, med.ID)
-			categories = append(categories, med.Category)
-		}
+	//The cart is repriced from the medicine table, the client's prices and order_total are not trusted.
+	//medicine rows are read through the cache, which stores the details of medicines frequently accessed.
+	cart_details, pricing, err := priceCart(c.Context(), connPool, cache, cart_details)
+	if err != nil {
+		return pricingError(err)
 	}
 
-	for _, id := range medicineIDs {
-		found := false
-		for _, cachedID := range medicines {
-			if id == cachedID {
-				found = true
-				break
-			}
-		}
-		if !found {
-			missingMedicineIDs = append(missingMedicineIDs, id)
-		}
+	var medicines []uuid.UUID;
+	for _, item := range cart_details.CartItems {
+		medicines = append(medicines, item.ID)
 	}
 
-	// missingMedicineIDs are only queried saving time. cache is also created for these keys. these keys are given a time limit.
-	// if it has not been accessed till that time limit. the cache expires
-	if len(missingMedicineIDs) > 0 {
-		medicine_query := "SELECT id,name,category,price from medicine WHERE id = ANY($1::uuid[])"
-		ctx := c.Context()
-
-		rows,err := connPool.Query(ctx, medicine_query, medicineIDs)
-		if err != nil {
-			fmt.Println("Error retreiving medicine Data")
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error" : err,
-			})
-		}
-		defer rows.Close()
-
-		for rows.Next(){
-			var m Medicine;
-			if err := rows.Scan(&m.ID, &m.Name, &m.Category, &m.Price); err != nil {
-				fmt.Println("Error retreiving medicine")
-				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-					"error" : err,
-				})
-			}
-			cacheKey := fmt.Sprintf("medicine:%s", m.ID.String())
-			cache.SetWithTTL(cacheKey, m, 1, time.Hour)
-
-			medicines = append(medicines, m.ID)
-			categories = append(categories, m.Category)
-		}
+	//A coupon targeting a category covers its subcategories, so the cart's categories are matched with their ancestors
+	lineage, err := cartCategoryLineage(c.Context(), connPool, cart_details)
+	if err != nil {
+		fmt.Printf("Error querying categories: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch categories")
 	}
+	categories := lineageCategories(lineage)
 
 	//JOIN request to query all the coupons eligible for given medicine and category.
-	couponQuery := `SELECT DISTINCT c.coupon_code, c.discount_type, c.discount_value, c.min_order_value
+	couponQuery := `SELECT DISTINCT c.coupon_code, c.discount_type, c.discount_value, c.discount_target, c.min_order_value,
+		COALESCE(c.max_discount_amount, 0), c.usage_type, c.expiry_date,
+		COALESCE(c.valid_from, 'epoch'::timestamp), COALESCE(c.valid_until, c.expiry_date),
+		COALESCE(c.order_condition::text, ''), COALESCE(c.order_number, 0), COALESCE(c.inactive_days, 0)
 	FROM coupon c
 	LEFT JOIN coupon_medicine_map cmm ON c.coupon_code = cmm.coupon_code
 	LEFT JOIN coupon_category_map ccm ON c.coupon_code = ccm.coupon_code
-	WHERE cmm.medicine_id = ANY($1::uuid[]) OR ccm.category_name = ANY($2::text[])
+	WHERE (cmm.medicine_id = ANY($1::uuid[]) OR ccm.category_name = ANY($2::text[]) OR ` + siteWideCondition + `) AND c.is_active AND NOT c.is_template
+		AND ` + availableToUser(3) + `
 	`
 
-	var applicableCoupons []ApplicableCoupon
-	rows,err := connPool.Query(c.Context(), couponQuery, medicines, categories)
+	var candidates []CouponData
+	var candidate CouponData
+	rows, _ := connPool.Query(c.Context(), couponQuery, medicines, categories, req.UserID)
+	_, err = pgx.ForEachRow(rows, []any{&candidate.CouponCode, &candidate.DiscountType, &candidate.DiscountValue, &candidate.DiscountTarget, &candidate.MinOrderValue, &candidate.MaxDiscountAmount, &candidate.UsageType, &candidate.ExpiryDate, &candidate.ValidFrom, &candidate.ValidUntil, &candidate.OrderCondition, &candidate.OrderNumber, &candidate.InactiveDays}, func() error {
+		candidates = append(candidates, candidate)
+		return nil
+	})
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error" : err,
-		})
+		fmt.Printf("Error querying coupons: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupons")
 	}
-	for rows.Next() {
-		var coupon_code, discount_type string;
-		var discount_value, min_order_value float64;
-		if err := rows.Scan(&coupon_code, &discount_type, &discount_value, &min_order_value); err != nil {
-			fmt.Println("Error retreiving coupon code")
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error" : err,
-			})
+
+	//The maps and exclusions decide which cart items a coupon covers, time_based coupons are only
+	//applicable inside one of their schedule windows
+	if err := loadCouponRules(c.Context(), connPool, candidates); err != nil {
+		fmt.Printf("Error querying coupon rules: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon rules")
+	}
+	timestamp := cart_details.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	//The user's order history is only read when a candidate has an order-history condition
+	var history *OrderHistory
+
+	var applicableCoupons []ApplicableCoupon
+	notApplicable := []RejectedCoupon{}
+	for _, coupon := range candidates {
+		//A coupon whose exclusions cover every item of the cart is left out, charges only coupons apply to any cart
+		if !coversCart(coupon, cart_details, lineage) {
+			continue
 		}
 
 		//The eligiblity is checked and discount for individual coupon code is calculated.
-		var discount float64
-		if cart_details.OrderTotal >= min_order_value {
-			if discount_type == "flat" {
-				discount = discount_value;
-			}else if discount_type == "percentage" {
-				discount = cart_details.OrderTotal * (discount_value / 100);
+		if checkValidity(coupon, timestamp) == nil && cart_details.OrderTotal >= coupon.MinOrderValue {
+			//A coupon the user's order history doesn't qualify for is listed in not_applicable with the reason
+			if coupon.OrderCondition != "" {
+				if history == nil {
+					loaded, err := loadOrderHistory(c.Context(), connPool, req.UserID, "")
+					if err != nil {
+						fmt.Printf("Error querying order history: %v\n", err)
+						return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch order history")
+					}
+					history = &loaded
+				}
+				if rejection := checkOrderCondition(coupon, *history, timestamp); rejection != nil {
+					notApplicable = append(notApplicable, RejectedCoupon{CouponCode: coupon.CouponCode, Reasons: []CouponRejection{*rejection}})
+					continue
+				}
 			}
+
+			//Only the cart items the coupon covers are discounted, as /coupon/validate does, charges line by line
+			lines, capApplied := calculateDiscount(coupon, coveredLines(coupon, cart_details, lineage), cart_details.Charges)
 			applicableCoupons = append(applicableCoupons, ApplicableCoupon{
-				CouponCode : coupon_code,
-				DiscountValue : discount,
+				CouponCode : coupon.CouponCode,
+				DiscountValue : sumDiscounts(lines, lineKindItem) + sumDiscounts(lines, lineKindCharge),
+				CapApplied : capApplied,
+				Condition : describeOrderCondition(coupon),
 			})
 		}
 	}
 
 	return c.JSON(fiber.Map{
 		"applicable_coupons": applicableCoupons,
+		"not_applicable": notApplicable,
+		"pricing": pricing,
 	})
 }
 
 // ValidateCoupon godoc
 // @Summary Validate a coupon
-// @Description Check if a coupon is valid for the given order
+// @Description Check if a coupon is valid for the given order. The cart is repriced from the medicine table and a differing order_total is flagged in pricing. The user's usage is not consumed, use /coupon/reserve and /coupon/commit to redeem it
 // @Tags Coupons
 // @Accept json
 // @Produce json
 // @Param request body ValidateCoupon true "Validation request"
+// @Param Idempotency-Key header string false "Retries with the same key replay the first response"
 // @Success 200 {object} map[string]interface{} "Validation result"
-// @Failure 400 {object} map[string]interface{} "Bad request"
+// @Failure 400 {object} Problem "Bad request"
+// @Failure 404 {object} Problem "Coupon not found"
 // @Router /coupon/validate [post]
-func validateCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+func validateCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool, cache *ristretto.Cache) error {
 	var coupon_details ValidateCoupon
 	if err := c.BodyParser(&coupon_details); err != nil {
 		fmt.Println("Invalid Input")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error" : err,
-		})
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, err.Error())
+	}
+	if err := validateCharges(coupon_details.Charges); err != nil {
+		return err
 	}
 
 	ctx := c.Context()
-	tx, err := connPool.Begin(ctx)
+	var pricing CartPricing
+	var err error
+	coupon_details.OrderInput, pricing, err = priceCart(ctx, connPool, cache, coupon_details.OrderInput)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to begin transaction"})
+		return pricingError(err)
 	}
-	defer tx.Rollback(ctx)
-
-	var currentUsage int
-
-	//A query to get the number of times a coupon has been redemmed by a user
-	err = tx.QueryRow(ctx,`SELECT usage FROM coupon_usage WHERE user_id = $1 AND coupon_code = $2 FOR UPDATE`, coupon_details.UserID, coupon_details.CouponCode).Scan(&currentUsage)
 
-	if err != nil {
-		if err.Error() == "no rows in result set" {
-			currentUsage = 0
-		} else {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch usage"})
-		}
+	coupon_data, err := loadCoupon(ctx, connPool, coupon_details.CouponCode)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeCouponNotFound, "Coupon not found")
 	}
-
-	//Query to get the coupon detail
-	couponQuery := `SELECT 
-		coupon_code,
-    expiry_date,
-    usage_type,
-    min_order_value,
-    valid_from,
-    valid_until,
-    discount_type,
-    discount_value,
-    discount_target,
-    max_usage_per_user,
-    terms_and_conditions	
-	FROM coupon WHERE coupon_code = $1`
-	rows, err := connPool.Query(ctx, couponQuery, coupon_details.CouponCode)
 	if err != nil {
 		fmt.Println("Error retrieving Coupon details.")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error" : err.Error(),
-		})
-	}
-
-	var coupon_data CouponData
-	for rows.Next(){
-		if err = rows.Scan( 
-			&coupon_data.CouponCode, 
-			&coupon_data.ExpiryDate, 
-			&coupon_data.UsageType, 
-			&coupon_data.MinOrderValue, 
-			&coupon_data.ValidFrom, 
-			&coupon_data.ValidUntil, 
-			&coupon_data.DiscountType, 
-			&coupon_data.DiscountValue, 
-			&coupon_data.DiscountTarget,  
-			&coupon_data.MaxUsagePerUser,
-			&coupon_data.TermsAndConditions); err != nil {
-			fmt.Println("Error scanning coupon.")
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error" : err.Error(),
-			})
-		}
-	}
-	fmt.Println("Coupon data: %v", coupon_data)
-
-	//checks the user usage vs coupon's max usage
-	if currentUsage >= coupon_data.MaxUsagePerUser {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"is_valid": false,
-			"message":  "Coupon usage limit exceeded for this user",
-		})
-	}
-
-	//Increments the user's usage
-	if currentUsage == 0 {
-		_, err = tx.Exec(ctx, `
-			INSERT INTO coupon_usage (user_id, coupon_code, usage)
-			VALUES ($1, $2, 1)
-		`, coupon_details.UserID, coupon_details.CouponCode)
-	} else {
-		_, err = tx.Exec(ctx, `
-			UPDATE coupon_usage
-			SET usage = usage + 1
-			WHERE user_id = $1 AND coupon_code = $2
-		`, coupon_details.UserID, coupon_details.CouponCode)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon")
 	}
 
+	// Validation only previews the discount. The usage slot is taken by /coupon/reserve
+	// and consumed by /coupon/commit once the order is placed.
+	evaluation, err := evaluateCoupon(ctx, connPool, coupon_data, coupon_details)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update usage"})
+		fmt.Printf("Error evaluating coupon: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to evaluate coupon")
 	}
-	
-	if err := tx.Commit(ctx); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Transaction commit failed"})
-	}
-
-	//checks the coupon validity using the valid.from and valid_until
-	timestamp := coupon_details.Timestamp
-	if coupon_data.ValidFrom.IsZero() && timestamp.Before(coupon_data.ValidFrom) || 
-	coupon_data.ValidUntil.IsZero() && timestamp.After(coupon_data.ValidUntil) || 
-	timestamp.After(coupon_data.ExpiryDate) {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"is_valid": false,
-			"reason":   "coupon expired or not applicable",
-		})
-	}
-
-	//checks the min Order value of the cart
-	if coupon_details.OrderTotal <= coupon_data.MinOrderValue {
-		return c.JSON(fiber.Map{
-			"is_valid" : false,
-			"message" : "The orderTotal doesnt pass minimum order Value.",
-		})
-	}
-
-	//eligible medicine id and category is filtered out
-	medicineIDs := make([]uuid.UUID, len(coupon_details.CartItems))
-	for i, item := range coupon_details.CartItems {
-			fmt.Println(item.ID, i)
-			medicineIDs[i] = item.ID
-	}
-
-	//queries all the medicine ids eligible for the coupon
-	medicineQuery := `SELECT medicine_id FROM coupon_medicine_map WHERE coupon_code=$1`
-	rows, err = connPool.Query(ctx, medicineQuery, coupon_details.CouponCode)
-	if err != nil {
-		fmt.Println("Error retrieving medicine IDs")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error" : err.Error(),
-		})
-	}
-
-	couponMedicineIDs := make(map[uuid.UUID]bool)
-	for rows.Next(){
-		var id uuid.UUID
-		if err = rows.Scan(&id); err != nil {
-			fmt.Println("Error scanning Medicine IDs.")
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error" : err.Error(),
-			})
-		}
-		couponMedicineIDs[id] = true;
-	};
-
-	//filters out the medicine ids not suitable for the coupon.
-	var eligibleIds []uuid.UUID
-	for _, id := range medicineIDs{
-		if couponMedicineIDs[id]{
-			eligibleIds = append(eligibleIds, id)
-		}
-	}
-
-
-	//Discount is calculated on inventory and charges
-	medicinePriceQuery := `SELECT id,price FROM medicine WHERE id = ANY($1)`
-	rows, err = connPool.Query(ctx, medicinePriceQuery, eligibleIds)
-	var totalPrice, totalCharges float64
-	for rows.Next(){
-		var medicinePrice float64;
-		var medicine_id uuid.UUID;
-		if err = rows.Scan(&medicine_id,&medicinePrice); err != nil {
-			fmt.Println("Error scanning coupon.")
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error" : err.Error(),
-			})
-		}
-		fmt.Println(medicine_id)
-		if coupon_data.DiscountType == "flat" {
-			if coupon_data.DiscountTarget == "inventory"{
-				totalPrice = coupon_data.DiscountValue
-				fmt.Println(totalPrice)
-			} else if coupon_data.DiscountTarget == "charges" {
-				totalCharges = coupon_data.DiscountValue
-				fmt.Println(totalCharges)
-			} else if coupon_data.DiscountTarget == "inventory_and_charges" {
-				totalPrice = coupon_data.DiscountValue
-				totalCharges = coupon_data.DiscountValue
-				fmt.Println(totalPrice)
-				fmt.Println(totalCharges)
-			} else {
-				continue
-			}
-		}else if coupon_data.DiscountType == "percentage" {
-			if coupon_data.DiscountTarget == "inventory"{
-				totalPrice += medicinePrice * (coupon_data.DiscountValue / 100)
-				fmt.Println(totalPrice)
-			} else if coupon_data.DiscountTarget == "charges" {
-				totalCharges += medicinePrice * (coupon_data.DiscountValue / 100)
-				fmt.Println(totalCharges)
-			} else if coupon_data.DiscountTarget == "inventory_and_charges" {
-				totalPrice += medicinePrice * (coupon_data.DiscountValue / 100)
-				totalCharges += medicinePrice * (coupon_data.DiscountValue / 100)
-				fmt.Println(totalPrice)
-				fmt.Println(totalCharges)
-			} else {
-				continue
-			}
-		}
+	if !evaluation.IsValid {
+		return rejectionProblem(evaluation)
 	}
 
 	return c.JSON(fiber.Map{
 		"is_valid" : true,
 		"discount" : fiber.Map{
-			"items_discount" : totalPrice,
-			"charges_discount" : totalCharges,
+			"items_discount" : evaluation.ItemsDiscount,
+			"charges_discount" : evaluation.ChargesDiscount,
 		},
-		"order_value_after_discount" : coupon_details.OrderTotal - (totalPrice + totalCharges),
-		"message" : "Coupon applied succesfully",
+		"charges_after_discount" : evaluation.ChargesAfterDiscount,
+		"discount_breakdown" : evaluation.Breakdown,
+		"cap_applied" : evaluation.CapApplied,
+		"order_value_after_discount" : evaluation.OrderValueAfterDiscount(coupon_details.OrderInput),
+		"pricing" : pricing,
+		"message" : evaluation.Message,
 	})
 }
 
 // @title Farmako Coupon API
 // @version 1.0
-// @description API for managing medicine coupons and discounts
+// @description API for managing medicine coupons and discounts.
+// @description Every error is returned as an RFC 7807 application/problem+json body with a stable machine-readable code.
 // @contact.name API Support
 // @contact.email support@pharmaapp.com
 // @license.name Apache 2.0
@@ -594,6 +537,17 @@ func validateCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
 // @host localhost:3000
 // @BasePath /
 func main(){
+	//coupon schedules are evaluated in the configured timezone, IST unless COUPON_TIMEZONE says otherwise
+	timezone := os.Getenv("COUPON_TIMEZONE")
+	if timezone == "" {
+		timezone = "Asia/Kolkata"
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		log.Fatalf("Invalid COUPON_TIMEZONE %q: %v", timezone, err)
+	}
+	couponLocation = location
+
 	db_url := "postgres://postgres:password@db:5432/coupondb"
 	config, err := pgxpool.ParseConfig(db_url)
 
@@ -620,23 +574,213 @@ func main(){
 		log.Fatalf("failed to create cache: %v", err)
 	}
 
-	app := fiber.New()
+	// Every error a handler returns is sent as an RFC 7807 problem with a stable error code
+	app := fiber.New(fiber.Config{
+		ErrorHandler: problemHandler,
+	})
 	app.Post("/admin/addCoupons", func(c *fiber.Ctx) error {
     return addCouponHandler(c, connPool)
 	})
 
-	app.Post("/coupon/update", func(c *fiber.Ctx) error {
-    return updateCouponHandler(c,connPool)
+	app.Get("/admin/coupons", func(c *fiber.Ctx) error {
+		return listCouponsHandler(c, connPool)
+	})
+
+	app.Get("/admin/coupons/:code", func(c *fiber.Ctx) error {
+		return getCouponHandler(c, connPool)
+	})
+
+	app.Delete("/admin/coupons/:code", func(c *fiber.Ctx) error {
+		return deleteCouponHandler(c, connPool)
+	})
+
+	app.Post("/admin/coupons/:code/deactivate", func(c *fiber.Ctx) error {
+		return deactivateCouponHandler(c, connPool)
+	})
+
+	app.Post("/admin/coupons/:code/reactivate", func(c *fiber.Ctx) error {
+		return reactivateCouponHandler(c, connPool)
+	})
+
+	app.Post("/admin/coupons/:code/medicines", func(c *fiber.Ctx) error {
+		return addCouponMedicinesHandler(c, connPool)
+	})
+
+	app.Delete("/admin/coupons/:code/medicines/:medicine_id", func(c *fiber.Ctx) error {
+		return removeCouponMedicineHandler(c, connPool)
+	})
+
+	app.Post("/admin/coupons/:code/categories", func(c *fiber.Ctx) error {
+		return addCouponCategoriesHandler(c, connPool)
+	})
+
+	app.Delete("/admin/coupons/:code/categories/:category", func(c *fiber.Ctx) error {
+		return removeCouponCategoryHandler(c, connPool)
+	})
+
+	app.Get("/admin/coupons/:code/history", func(c *fiber.Ctx) error {
+		return couponHistoryHandler(c, connPool)
+	})
+
+	app.Get("/admin/coupons/:code/budget", func(c *fiber.Ctx) error {
+		return couponBudgetHandler(c, connPool)
+	})
+
+	app.Patch("/admin/coupons/:code", func(c *fiber.Ctx) error {
+		return updateCouponHandler(c, connPool)
+	})
+
+	app.Post("/admin/coupons/:code/users", func(c *fiber.Ctx) error {
+		return assignCouponUsersHandler(c, connPool)
+	})
+
+	app.Delete("/admin/coupons/:code/users/:user_id", func(c *fiber.Ctx) error {
+		return revokeCouponUserHandler(c, connPool)
+	})
+
+	app.Post("/admin/coupons/:code/cohorts", func(c *fiber.Ctx) error {
+		return assignCouponCohortsHandler(c, connPool)
+	})
+
+	app.Delete("/admin/coupons/:code/cohorts/:cohort_id", func(c *fiber.Ctx) error {
+		return revokeCouponCohortHandler(c, connPool)
+	})
+
+	app.Post("/admin/cohorts", func(c *fiber.Ctx) error {
+		return createCohortHandler(c, connPool)
+	})
+
+	app.Get("/admin/cohorts/:id", func(c *fiber.Ctx) error {
+		return getCohortHandler(c, connPool)
+	})
+
+	app.Post("/admin/cohorts/:id/users", func(c *fiber.Ctx) error {
+		return addCohortUsersHandler(c, connPool)
+	})
+
+	app.Delete("/admin/cohorts/:id/users/:user_id", func(c *fiber.Ctx) error {
+		return removeCohortUserHandler(c, connPool)
+	})
+
+	app.Get("/admin/users/:user_id/coupons", func(c *fiber.Ctx) error {
+		return userCouponsHandler(c, connPool)
+	})
+
+	app.Get("/admin/redemptions", func(c *fiber.Ctx) error {
+		return listRedemptionsHandler(c, connPool)
+	})
+
+	app.Post("/admin/campaigns", func(c *fiber.Ctx) error {
+		return createCampaignHandler(c, connPool)
+	})
+
+	app.Get("/admin/campaigns/:id", func(c *fiber.Ctx) error {
+		return getCampaignHandler(c, connPool)
+	})
+
+	app.Post("/admin/campaigns/:id/codes", func(c *fiber.Ctx) error {
+		return generateCampaignCodesHandler(c, connPool)
+	})
+
+	app.Get("/admin/campaigns/:id/export", func(c *fiber.Ctx) error {
+		return exportCampaignCodesHandler(c, connPool)
+	})
+
+	app.Get("/admin/categories", func(c *fiber.Ctx) error {
+		return listCategoriesHandler(c, connPool)
+	})
+
+	app.Post("/admin/categories", func(c *fiber.Ctx) error {
+		return createCategoryHandler(c, connPool)
+	})
+
+	app.Get("/admin/categories/:name", func(c *fiber.Ctx) error {
+		return getCategoryHandler(c, connPool)
+	})
+
+	app.Patch("/admin/categories/:name", func(c *fiber.Ctx) error {
+		return moveCategoryHandler(c, connPool)
+	})
+
+	app.Delete("/admin/categories/:name", func(c *fiber.Ctx) error {
+		return deleteCategoryHandler(c, connPool)
+	})
+
+	app.Post("/admin/medicines", func(c *fiber.Ctx) error {
+		return createMedicineHandler(c, connPool)
+	})
+
+	app.Put("/admin/medicines", func(c *fiber.Ctx) error {
+		return bulkUpsertMedicinesHandler(c, connPool, cache)
+	})
+
+	app.Get("/admin/medicines/:id", func(c *fiber.Ctx) error {
+		return getMedicineHandler(c, connPool)
+	})
+
+	app.Patch("/admin/medicines/:id", func(c *fiber.Ctx) error {
+		return updateMedicineHandler(c, connPool, cache)
+	})
+
+	app.Post("/admin/medicines/:id/deactivate", func(c *fiber.Ctx) error {
+		return deactivateMedicineHandler(c, connPool, cache)
+	})
+
+	app.Post("/admin/medicines/:id/reactivate", func(c *fiber.Ctx) error {
+		return reactivateMedicineHandler(c, connPool, cache)
 	})
 	
 	app.Post("/coupon/applicable", func(c *fiber.Ctx) error {
     return getApplicableCoupons(c,connPool,cache)
 	})
 
-	app.Post("/coupon/validate",func(c *fiber.Ctx) error {
-    return validateCouponHandler(c,connPool)
+	// Checkout retries these on timeouts, the Idempotency-Key header makes a retry replay the first response
+	idempotent := idempotencyMiddleware(connPool)
+
+	app.Post("/coupon/validate", idempotent, func(c *fiber.Ctx) error {
+    return validateCouponHandler(c,connPool,cache)
+	})
+
+	app.Post("/coupon/best", func(c *fiber.Ctx) error {
+		return bestCouponHandler(c, connPool, cache)
+	})
+
+	app.Post("/coupon/explain", func(c *fiber.Ctx) error {
+		return explainCouponsHandler(c, connPool, cache)
+	})
+
+	app.Get("/coupon/wallet/:user_id", func(c *fiber.Ctx) error {
+		return couponWalletHandler(c, connPool)
 	})
 
+	app.Post("/orders", func(c *fiber.Ctx) error {
+		return recordOrderHandler(c, connPool)
+	})
+
+	app.Post("/coupon/apply", func(c *fiber.Ctx) error {
+		return applyCouponsHandler(c, connPool, cache)
+	})
+
+	app.Post("/coupon/reserve", idempotent, func(c *fiber.Ctx) error {
+		return reserveCouponHandler(c, connPool, cache)
+	})
+
+	app.Post("/coupon/commit", idempotent, func(c *fiber.Ctx) error {
+		return commitReservationHandler(c, connPool)
+	})
+
+	app.Post("/coupon/release", idempotent, func(c *fiber.Ctx) error {
+		return releaseReservationHandler(c, connPool)
+	})
+
+	app.Post("/coupon/reverse", idempotent, func(c *fiber.Ctx) error {
+		return reverseRedemptionHandler(c, connPool)
+	})
+
+	// Abandoned reservations are swept in the background so their status reflects the lapsed hold
+	go sweepExpiredReservations(ctx, connPool, time.Minute)
+	go sweepIdempotencyKeys(ctx, connPool, time.Hour)
+
 	app.Get("/swagger/*", swagger.HandlerDefault)
 
 	app.Listen(":3000")
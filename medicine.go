@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// CatalogueMedicine is a medicine as the catalogue API receives and returns it.
+// is_active is only changed through the deactivate and reactivate endpoints.
+type CatalogueMedicine struct {
+	ID       uuid.UUID `json:"id"`
+	Name     string    `json:"name" validate:"required,max=255"`
+	Category string    `json:"category" validate:"required,max=100"`
+	Price    float64   `json:"price" validate:"gt=0"`
+	IsActive bool      `json:"is_active"`
+}
+
+// BulkMedicinesRequest is used in PUT /admin/medicines
+type BulkMedicinesRequest struct {
+	Medicines []CatalogueMedicine `json:"medicines" validate:"required,min=1,max=1000,dive"`
+}
+
+// invalidateMedicines drops the cached rows of the medicines so the next cart is priced from the table.
+// It is called once the write is committed. Bumping the generations keeps a reader that queried the
+// old row before the commit from caching it after the row was dropped.
+func invalidateMedicines(cache *ristretto.Cache, ids ...uuid.UUID) {
+	medicineGenerations.Lock()
+	defer medicineGenerations.Unlock()
+	for _, id := range ids {
+		medicineGenerations.counts[id]++
+		cache.Del(medicineCacheKey(id))
+	}
+}
+
+// loadCatalogueMedicine reads a medicine, active or not. pgx.ErrNoRows is returned when it does not exist.
+func loadCatalogueMedicine(ctx context.Context, q querier, id uuid.UUID) (CatalogueMedicine, error) {
+	rows, _ := q.Query(ctx, `SELECT id, name, category, price, is_active FROM medicine WHERE id = $1`, id)
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByPos[CatalogueMedicine])
+}
+
+// medicineID parses the medicine ID of the path
+func medicineID(c *fiber.Ctx) (uuid.UUID, error) {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return id, newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid medicine id")
+	}
+	return id, nil
+}
+
+// GetMedicine godoc
+// @Summary Get a medicine
+// @Tags Medicines
+// @Produce json
+// @Param id path string true "Medicine ID"
+// @Success 200 {object} CatalogueMedicine "Medicine"
+// @Failure 404 {object} Problem "Medicine not found"
+// @Security ApiKeyAuth
+// @Router /admin/medicines/{id} [get]
+func getMedicineHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	id, err := medicineID(c)
+	if err != nil {
+		return err
+	}
+	medicine, err := loadCatalogueMedicine(c.Context(), connPool, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeNotFound, "Medicine not found")
+	}
+	if err != nil {
+		fmt.Printf("Error fetching medicine: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch medicine")
+	}
+	return c.JSON(medicine)
+}
+
+// CreateMedicine godoc
+// @Summary Add a medicine to the catalogue
+// @Description Adds an active medicine. An ID is generated when the body has none
+// @Tags Medicines
+// @Accept json
+// @Produce json
+// @Param medicine body CatalogueMedicine true "Medicine"
+// @Success 201 {object} CatalogueMedicine "Medicine"
+// @Failure 400 {object} Problem "Validation errors"
+// @Failure 409 {object} Problem "Medicine ID already exists"
+// @Security ApiKeyAuth
+// @Router /admin/medicines [post]
+func createMedicineHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	var medicine CatalogueMedicine
+	if err := c.BodyParser(&medicine); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if err := validate.Struct(medicine); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+	if medicine.ID == uuid.Nil {
+		medicine.ID = uuid.New()
+	}
+	medicine.IsActive = true
+
+	_, err := connPool.Exec(c.Context(), `INSERT INTO medicine (id, name, category, price) VALUES ($1, $2, $3, $4)`,
+		medicine.ID, medicine.Name, medicine.Category, medicine.Price)
+	if err != nil {
+		return databaseProblem(err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(medicine)
+}
+
+// UpdateMedicine godoc
+// @Summary Update a medicine
+// @Description Changes the name, category or price of a medicine. Fields left out of the body keep their value. The cached row is dropped so carts are priced with the change right away
+// @Tags Medicines
+// @Accept json
+// @Produce json
+// @Param id path string true "Medicine ID"
+// @Param medicine body CatalogueMedicine true "Fields to change"
+// @Success 200 {object} CatalogueMedicine "Medicine"
+// @Failure 400 {object} Problem "Validation errors"
+// @Failure 404 {object} Problem "Medicine not found"
+// @Security ApiKeyAuth
+// @Router /admin/medicines/{id} [patch]
+func updateMedicineHandler(c *fiber.Ctx, connPool *pgxpool.Pool, cache *ristretto.Cache) error {
+	id, err := medicineID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Context()
+	tx, err := connPool.Begin(ctx)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM medicine WHERE id = $1 FOR UPDATE`, id); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to lock medicine")
+	}
+	medicine, err := loadCatalogueMedicine(ctx, tx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeNotFound, "Medicine not found")
+	}
+	if err != nil {
+		fmt.Printf("Error fetching medicine: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch medicine")
+	}
+
+	// The body is parsed over the current row so only the fields it carries change
+	isActive := medicine.IsActive
+	if err := c.BodyParser(&medicine); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if medicine.ID != id {
+		return validationProblem(map[string]string{"ID": "id can't be changed."})
+	}
+	medicine.IsActive = isActive
+	if err := validate.Struct(medicine); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE medicine SET name = $2, category = $3, price = $4 WHERE id = $1`,
+		medicine.ID, medicine.Name, medicine.Category, medicine.Price)
+	if err != nil {
+		return databaseProblem(err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
+	}
+
+	invalidateMedicines(cache, id)
+	return c.JSON(medicine)
+}
+
+// BulkUpsertMedicines godoc
+// @Summary Create or update medicines in bulk
+// @Description Inserts the medicines that don't exist and updates the name, category and price of the ones that do, in one transaction. Every medicine needs an id
+// @Tags Medicines
+// @Accept json
+// @Produce json
+// @Param request body BulkMedicinesRequest true "Medicines"
+// @Success 200 {object} map[string]interface{} "Created and updated counts"
+// @Failure 400 {object} Problem "Validation errors"
+// @Security ApiKeyAuth
+// @Router /admin/medicines [put]
+func bulkUpsertMedicinesHandler(c *fiber.Ctx, connPool *pgxpool.Pool, cache *ristretto.Cache) error {
+	var req BulkMedicinesRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+	ids := make([]uuid.UUID, len(req.Medicines))
+	seen := make(map[uuid.UUID]bool, len(req.Medicines))
+	for i, medicine := range req.Medicines {
+		if medicine.ID == uuid.Nil || seen[medicine.ID] {
+			return validationProblem(map[string]string{
+				fmt.Sprintf("Medicines[%d].ID", i): "every medicine needs a distinct id.",
+			})
+		}
+		seen[medicine.ID] = true
+		ids[i] = medicine.ID
+	}
+
+	ctx := c.Context()
+	tx, err := connPool.Begin(ctx)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	var created, updated int
+	for _, medicine := range req.Medicines {
+		// xmax is zero for a row the statement inserted and set for one it updated
+		var inserted bool
+		err := tx.QueryRow(ctx, `INSERT INTO medicine (id, name, category, price) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, category = EXCLUDED.category, price = EXCLUDED.price
+			RETURNING xmax = 0`, medicine.ID, medicine.Name, medicine.Category, medicine.Price).Scan(&inserted)
+		if err != nil {
+			return databaseProblem(err)
+		}
+		if inserted {
+			created++
+		} else {
+			updated++
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
+	}
+
+	invalidateMedicines(cache, ids...)
+	return c.JSON(fiber.Map{
+		"created": created,
+		"updated": updated,
+	})
+}
+
+// setMedicineActive flips is_active, drops the cached row and responds with the medicine
+func setMedicineActive(c *fiber.Ctx, connPool *pgxpool.Pool, cache *ristretto.Cache, active bool) error {
+	id, err := medicineID(c)
+	if err != nil {
+		return err
+	}
+	tag, err := connPool.Exec(c.Context(), `UPDATE medicine SET is_active = $2 WHERE id = $1`, id, active)
+	if err != nil {
+		return databaseProblem(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return newProblem(fiber.StatusNotFound, codeNotFound, "Medicine not found")
+	}
+
+	invalidateMedicines(cache, id)
+	return getMedicineHandler(c, connPool)
+}
+
+// DeactivateMedicine godoc
+// @Summary Deactivate a medicine
+// @Description Takes the medicine off sale, carts holding it are rejected with INVALID_CART. Coupon maps to it are kept
+// @Tags Medicines
+// @Produce json
+// @Param id path string true "Medicine ID"
+// @Success 200 {object} CatalogueMedicine "Medicine"
+// @Failure 404 {object} Problem "Medicine not found"
+// @Security ApiKeyAuth
+// @Router /admin/medicines/{id}/deactivate [post]
+func deactivateMedicineHandler(c *fiber.Ctx, connPool *pgxpool.Pool, cache *ristretto.Cache) error {
+	return setMedicineActive(c, connPool, cache, false)
+}
+
+// ReactivateMedicine godoc
+// @Summary Reactivate a medicine
+// @Description Puts a deactivated medicine back on sale
+// @Tags Medicines
+// @Produce json
+// @Param id path string true "Medicine ID"
+// @Success 200 {object} CatalogueMedicine "Medicine"
+// @Failure 404 {object} Problem "Medicine not found"
+// @Security ApiKeyAuth
+// @Router /admin/medicines/{id}/reactivate [post]
+func reactivateMedicineHandler(c *fiber.Ctx, connPool *pgxpool.Pool, cache *ristretto.Cache) error {
+	return setMedicineActive(c, connPool, cache, true)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Order-history conditions of a coupon, checked against the user_order ledger
+const (
+	orderFirst    = "first_order"
+	orderNth      = "nth_order"
+	orderInactive = "inactive_days"
+)
+
+// RecordOrderRequest is used in POST /orders. The order is placed when it is recorded.
+type RecordOrderRequest struct {
+	OrderID string `json:"order_id" validate:"required,max=100"`
+	UserID  string `json:"user_id" validate:"required,uuid"`
+}
+
+// OrderHistory is what the ledger knows of the orders a user has placed
+type OrderHistory struct {
+	Orders      int        `json:"orders"`
+	LastOrderAt *time.Time `json:"last_order_at"`
+}
+
+// recordOrder adds a placed order to the ledger. Recording an order again keeps the first entry.
+func recordOrder(ctx context.Context, q querier, orderID string, userID uuid.UUID, placedAt time.Time) (bool, error) {
+	tag, err := q.Exec(ctx, `INSERT INTO user_order (order_id, user_id, placed_at) VALUES ($1, $2, $3)
+		ON CONFLICT (order_id) DO NOTHING`, orderID, userID, placedAt)
+	return tag.RowsAffected() > 0, err
+}
+
+// loadOrderHistory counts the orders the user has placed so far and finds the latest of them.
+// Cancelled orders don't count, nor does exceptOrder, the order being placed when it was recorded already.
+// The history is read as of now, not the request's timestamp, so a backdated request can't hide the
+// user's orders from first_order or inactive_days.
+func loadOrderHistory(ctx context.Context, q querier, userID uuid.UUID, exceptOrder string) (OrderHistory, error) {
+	var history OrderHistory
+	err := q.QueryRow(ctx, `SELECT count(*), max(placed_at) FROM user_order
+		WHERE user_id = $1 AND order_id <> $2 AND placed_at <= now() AND cancelled_at IS NULL`,
+		userID, exceptOrder).Scan(&history.Orders, &history.LastOrderAt)
+	return history, err
+}
+
+// lockUserOrders serialises the transactions that check the user's order history or record an order for
+// the user until the transaction ends, so two orders can't both pass first_order before either is recorded
+func lockUserOrders(ctx context.Context, q querier, userID uuid.UUID) error {
+	_, err := q.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('user_order'), hashtext($1::text))`, userID)
+	return err
+}
+
+// checkOrderCondition returns why the order placed at the timestamp doesn't meet the coupon's
+// order-history condition, or nil when it does or the coupon has none
+func checkOrderCondition(coupon CouponData, history OrderHistory, timestamp time.Time) *CouponRejection {
+	switch coupon.OrderCondition {
+	case orderFirst:
+		if history.Orders > 0 {
+			return &CouponRejection{Code: reasonNotFirstOrder, Message: "Coupon is only valid on the first order"}
+		}
+	case orderNth:
+		if history.Orders+1 != coupon.OrderNumber {
+			return &CouponRejection{Code: reasonNotNthOrder,
+				Message: fmt.Sprintf("Coupon is only valid on order number %d, this is order number %d", coupon.OrderNumber, history.Orders+1)}
+		}
+	case orderInactive:
+		if history.LastOrderAt != nil && history.LastOrderAt.After(timestamp.AddDate(0, 0, -coupon.InactiveDays)) {
+			return &CouponRejection{Code: reasonRecentOrder,
+				Message: fmt.Sprintf("Coupon is only valid without an order in the last %d days", coupon.InactiveDays)}
+		}
+	}
+	return nil
+}
+
+// describeOrderCondition puts the coupon's order-history condition into words, empty when it has none
+func describeOrderCondition(coupon CouponData) string {
+	switch coupon.OrderCondition {
+	case orderFirst:
+		return "First order only"
+	case orderNth:
+		return fmt.Sprintf("Order number %d only", coupon.OrderNumber)
+	case orderInactive:
+		return fmt.Sprintf("No order in the last %d days", coupon.InactiveDays)
+	}
+	return ""
+}
+
+// RecordOrder godoc
+// @Summary Record a placed order
+// @Description Adds the order to the ledger order-history coupon conditions are checked against. Orders redeeming a coupon are recorded by /coupon/commit, orders placed without a coupon have to be recorded here. Recording an order again is a no-op. The order is placed when it is recorded
+// @Tags Coupons
+// @Accept json
+// @Produce json
+// @Param request body RecordOrderRequest true "Order"
+// @Success 200 {object} map[string]interface{} "User's order history"
+// @Failure 400 {object} Problem "Validation errors"
+// @Router /orders [post]
+func recordOrderHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	var req RecordOrderRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+	userID := uuid.MustParse(req.UserID)
+
+	ctx := c.Context()
+	tx, err := connPool.Begin(ctx)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	// The order waits for a commit checking the user's order history to finish
+	if err := lockUserOrders(ctx, tx, userID); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to lock orders")
+	}
+	recorded, err := recordOrder(ctx, tx, req.OrderID, userID, time.Now())
+	if err != nil {
+		return databaseProblem(err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
+	}
+
+	history, err := loadOrderHistory(ctx, connPool, userID, "")
+	if err != nil {
+		fmt.Printf("Error fetching order history: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch order history")
+	}
+	return c.JSON(fiber.Map{
+		"order_id": req.OrderID,
+		"user_id":  userID,
+		"recorded": recorded,
+		"history":  history,
+	})
+}
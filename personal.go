@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// CouponUsersRequest assigns a personal coupon to users
+type CouponUsersRequest struct {
+	UserIDs []string `json:"user_ids" validate:"required,min=1,max=100000,dive,uuid"`
+}
+
+// CouponCohortsRequest assigns a personal coupon to cohorts
+type CouponCohortsRequest struct {
+	CohortIDs []int `json:"cohort_ids" validate:"required,min=1,dive,gt=0"`
+}
+
+// CreateCohortRequest is used in POST /admin/cohorts
+type CreateCohortRequest struct {
+	Name    string   `json:"name" validate:"required,max=255"`
+	UserIDs []string `json:"user_ids" validate:"required,min=1,max=100000,dive,uuid"`
+}
+
+// Cohort is a named group of users personal coupons can be assigned to
+type Cohort struct {
+	CohortID    int       `json:"cohort_id"`
+	Name        string    `json:"name"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	MemberCount int       `json:"member_count"`
+}
+
+// availableToUser is the SQL condition a coupon row c meets when it is not personal or is assigned to
+// the user of the placeholder, directly or through one of the user's cohorts
+func availableToUser(param int) string {
+	return fmt.Sprintf(`(NOT c.is_personal
+		OR EXISTS (SELECT 1 FROM coupon_user_assignment a WHERE a.coupon_code = c.coupon_code AND a.user_id = $%[1]d)
+		OR EXISTS (SELECT 1 FROM coupon_cohort_assignment ca
+			JOIN user_cohort_member m ON m.cohort_id = ca.cohort_id
+			WHERE ca.coupon_code = c.coupon_code AND m.user_id = $%[1]d))`, param)
+}
+
+// couponAssignedTo reports whether the personal coupon is assigned to the user. Campaign codes are
+// assigned through their template.
+func couponAssignedTo(ctx context.Context, q querier, couponCode string, userID uuid.UUID) (bool, error) {
+	var assigned bool
+	err := q.QueryRow(ctx, `SELECT EXISTS (
+		SELECT 1 FROM coupon code
+		LEFT JOIN coupon_campaign cc ON cc.campaign_id = code.campaign_id
+		JOIN coupon c ON c.coupon_code = COALESCE(cc.template_code, code.coupon_code)
+		WHERE code.coupon_code = $1 AND `+availableToUser(2)+`)`, couponCode, userID).Scan(&assigned)
+	return assigned, err
+}
+
+// parseUserIDs parses user IDs the validator already checked
+func parseUserIDs(ids []string) []uuid.UUID {
+	userIDs := make([]uuid.UUID, len(ids))
+	for i, id := range ids {
+		userIDs[i] = uuid.MustParse(id)
+	}
+	return userIDs
+}
+
+// changeAssignments runs the assignment change for the coupon of the path and responds with the coupon.
+// Assigning users or cohorts makes the coupon personal, revoking them leaves it personal.
+func changeAssignments(c *fiber.Ctx, connPool *pgxpool.Pool, action string, assign bool, change func(ctx context.Context, tx pgx.Tx, code string) error) error {
+	err := changeCoupon(c, connPool, action, func(ctx context.Context, tx pgx.Tx, code string) error {
+		if err := checkNotCampaignCode(ctx, tx, code); err != nil {
+			return err
+		}
+		if assign {
+			if _, err := tx.Exec(ctx, `UPDATE coupon SET is_personal = true WHERE coupon_code = $1`, code); err != nil {
+				return err
+			}
+		}
+		return change(ctx, tx, code)
+	})
+	if err != nil {
+		return err
+	}
+	return getCouponHandler(c, connPool)
+}
+
+// AssignCouponUsers godoc
+// @Summary Assign a personal coupon to users
+// @Description Adds users to the coupon's allow-list and makes the coupon personal, only assigned users can use it from then on
+// @Tags Personal coupons
+// @Accept json
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Param request body CouponUsersRequest true "User IDs"
+// @Success 200 {object} CouponDetails "Coupon"
+// @Failure 400 {object} Problem "Validation errors"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code}/users [post]
+func assignCouponUsersHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	var req CouponUsersRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+	assignedBy := adminUser(c)
+	return changeAssignments(c, connPool, versionUsersAssigned, true, func(ctx context.Context, tx pgx.Tx, code string) error {
+		_, err := tx.Exec(ctx, `INSERT INTO coupon_user_assignment (coupon_code, user_id, assigned_by)
+			SELECT $1, unnest($2::uuid[]), $3 ON CONFLICT DO NOTHING`, code, parseUserIDs(req.UserIDs), assignedBy)
+		return err
+	})
+}
+
+// RevokeCouponUser godoc
+// @Summary Revoke a personal coupon from a user
+// @Description Removes the user from the coupon's allow-list. The user keeps the coupon while one of their cohorts is assigned
+// @Tags Personal coupons
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Param user_id path string true "User ID"
+// @Success 200 {object} CouponDetails "Coupon"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code}/users/{user_id} [delete]
+func revokeCouponUserHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	userID, err := uuid.Parse(c.Params("user_id"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid user id")
+	}
+	return changeAssignments(c, connPool, versionUserRevoked, false, func(ctx context.Context, tx pgx.Tx, code string) error {
+		_, err := tx.Exec(ctx, `DELETE FROM coupon_user_assignment WHERE coupon_code = $1 AND user_id = $2`, code, userID)
+		return err
+	})
+}
+
+// AssignCouponCohorts godoc
+// @Summary Assign a personal coupon to cohorts
+// @Description Makes the coupon available to every member of the cohorts and makes it personal
+// @Tags Personal coupons
+// @Accept json
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Param request body CouponCohortsRequest true "Cohort IDs"
+// @Success 200 {object} CouponDetails "Coupon"
+// @Failure 400 {object} Problem "Validation errors or unknown cohort"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code}/cohorts [post]
+func assignCouponCohortsHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	var req CouponCohortsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+	return changeAssignments(c, connPool, versionCohortsAssigned, true, func(ctx context.Context, tx pgx.Tx, code string) error {
+		_, err := tx.Exec(ctx, `INSERT INTO coupon_cohort_assignment (coupon_code, cohort_id)
+			SELECT $1, unnest($2::int[]) ON CONFLICT DO NOTHING`, code, req.CohortIDs)
+		return err
+	})
+}
+
+// RevokeCouponCohort godoc
+// @Summary Revoke a personal coupon from a cohort
+// @Tags Personal coupons
+// @Produce json
+// @Param code path string true "Coupon code"
+// @Param cohort_id path int true "Cohort ID"
+// @Success 200 {object} CouponDetails "Coupon"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Security ApiKeyAuth
+// @Router /admin/coupons/{code}/cohorts/{cohort_id} [delete]
+func revokeCouponCohortHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	cohortID, err := c.ParamsInt("cohort_id")
+	if err != nil || cohortID < 1 {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid cohort id")
+	}
+	return changeAssignments(c, connPool, versionCohortRevoked, false, func(ctx context.Context, tx pgx.Tx, code string) error {
+		_, err := tx.Exec(ctx, `DELETE FROM coupon_cohort_assignment WHERE coupon_code = $1 AND cohort_id = $2`, code, cohortID)
+		return err
+	})
+}
+
+// loadCohort reads a cohort with its member count. pgx.ErrNoRows is returned when it does not exist.
+func loadCohort(ctx context.Context, q querier, cohortID int) (Cohort, error) {
+	rows, _ := q.Query(ctx, `SELECT uc.cohort_id, uc.name, uc.created_by, uc.created_at,
+		(SELECT count(*) FROM user_cohort_member m WHERE m.cohort_id = uc.cohort_id)
+		FROM user_cohort uc WHERE uc.cohort_id = $1`, cohortID)
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByPos[Cohort])
+}
+
+// cohortID parses the cohort ID of the path
+func cohortID(c *fiber.Ctx) (int, error) {
+	id, err := c.ParamsInt("id")
+	if err != nil || id < 1 {
+		return 0, newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid cohort id")
+	}
+	return id, nil
+}
+
+// CreateCohort godoc
+// @Summary Upload a cohort of users
+// @Description Creates a named group of users that personal coupons can be assigned to
+// @Tags Personal coupons
+// @Accept json
+// @Produce json
+// @Param request body CreateCohortRequest true "Cohort name and user IDs"
+// @Success 201 {object} Cohort "Cohort"
+// @Failure 400 {object} Problem "Validation errors"
+// @Failure 409 {object} Problem "Cohort name already exists"
+// @Security ApiKeyAuth
+// @Router /admin/cohorts [post]
+func createCohortHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	var req CreateCohortRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+
+	ctx := c.Context()
+	tx, err := connPool.Begin(ctx)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	var id int
+	err = tx.QueryRow(ctx, `INSERT INTO user_cohort (name, created_by) VALUES ($1, $2) RETURNING cohort_id`,
+		req.Name, adminUser(c)).Scan(&id)
+	if err != nil {
+		return databaseProblem(err)
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO user_cohort_member (cohort_id, user_id)
+		SELECT $1, unnest($2::uuid[]) ON CONFLICT DO NOTHING`, id, parseUserIDs(req.UserIDs)); err != nil {
+		return databaseProblem(err)
+	}
+	cohort, err := loadCohort(ctx, tx, id)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch cohort")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
+	}
+	return c.Status(fiber.StatusCreated).JSON(cohort)
+}
+
+// GetCohort godoc
+// @Summary Get a cohort
+// @Tags Personal coupons
+// @Produce json
+// @Param id path int true "Cohort ID"
+// @Success 200 {object} Cohort "Cohort"
+// @Failure 404 {object} Problem "Cohort not found"
+// @Security ApiKeyAuth
+// @Router /admin/cohorts/{id} [get]
+func getCohortHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	id, err := cohortID(c)
+	if err != nil {
+		return err
+	}
+	cohort, err := loadCohort(c.Context(), connPool, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeNotFound, "Cohort not found")
+	}
+	if err != nil {
+		fmt.Printf("Error fetching cohort: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch cohort")
+	}
+	return c.JSON(cohort)
+}
+
+// AddCohortUsers godoc
+// @Summary Add users to a cohort
+// @Tags Personal coupons
+// @Accept json
+// @Produce json
+// @Param id path int true "Cohort ID"
+// @Param request body CouponUsersRequest true "User IDs"
+// @Success 200 {object} Cohort "Cohort"
+// @Failure 400 {object} Problem "Validation errors"
+// @Failure 404 {object} Problem "Cohort not found"
+// @Security ApiKeyAuth
+// @Router /admin/cohorts/{id}/users [post]
+func addCohortUsersHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	id, err := cohortID(c)
+	if err != nil {
+		return err
+	}
+	var req CouponUsersRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+
+	_, err = connPool.Exec(c.Context(), `INSERT INTO user_cohort_member (cohort_id, user_id)
+		SELECT $1, unnest($2::uuid[]) ON CONFLICT DO NOTHING`, id, parseUserIDs(req.UserIDs))
+	if err != nil {
+		problem := databaseProblem(err)
+		if problem.Status == fiber.StatusBadRequest {
+			return newProblem(fiber.StatusNotFound, codeNotFound, "Cohort not found")
+		}
+		return problem
+	}
+	return getCohortHandler(c, connPool)
+}
+
+// RemoveCohortUser godoc
+// @Summary Remove a user from a cohort
+// @Tags Personal coupons
+// @Produce json
+// @Param id path int true "Cohort ID"
+// @Param user_id path string true "User ID"
+// @Success 200 {object} Cohort "Cohort"
+// @Failure 404 {object} Problem "Cohort not found"
+// @Security ApiKeyAuth
+// @Router /admin/cohorts/{id}/users/{user_id} [delete]
+func removeCohortUserHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	id, err := cohortID(c)
+	if err != nil {
+		return err
+	}
+	userID, err := uuid.Parse(c.Params("user_id"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid user id")
+	}
+	if _, err := connPool.Exec(c.Context(), `DELETE FROM user_cohort_member WHERE cohort_id = $1 AND user_id = $2`, id, userID); err != nil {
+		return databaseProblem(err)
+	}
+	return getCohortHandler(c, connPool)
+}
+
+// UserCoupons godoc
+// @Summary List a user's personal coupons
+// @Description Lists the personal coupons assigned to the user, directly or through a cohort, in coupon code order
+// @Tags Personal coupons
+// @Produce json
+// @Param user_id path string true "User ID"
+// @Success 200 {object} map[string]interface{} "Personal coupons"
+// @Failure 400 {object} Problem "Invalid user id"
+// @Security ApiKeyAuth
+// @Router /admin/users/{user_id}/coupons [get]
+func userCouponsHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	userID, err := uuid.Parse(c.Params("user_id"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid user id")
+	}
+
+	coupons, err := queryCoupons(c.Context(), connPool, `WHERE c.is_personal AND `+availableToUser(1)+`
+		ORDER BY c.coupon_code`, userID)
+	if err != nil {
+		fmt.Printf("Error listing personal coupons: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to list coupons")
+	}
+
+	details := make([]CouponDetails, len(coupons))
+	for i, coupon := range coupons {
+		details[i] = couponDetails(coupon)
+	}
+	return c.JSON(fiber.Map{
+		"user_id": userID,
+		"coupons": details,
+	})
+}
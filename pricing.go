@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// priceTolerance is how far the client's order_total may drift from the repriced subtotal
+// before the cart is flagged, it absorbs rounding on the client
+const priceTolerance = 0.01
+
+// medicineCacheTTL is how long a medicine row stays in the cache without being read
+const medicineCacheTTL = time.Hour
+
+// CartPricing reports how the client's cart compares with the authoritative prices
+type CartPricing struct {
+	ClientTotal   float64 `json:"client_total"`
+	Subtotal      float64 `json:"subtotal"`
+	PriceMismatch bool    `json:"price_mismatch"`
+}
+
+// cartError is returned when the cart can't be priced because of what the client sent
+type cartError struct {
+	message     string
+	MedicineIDs []uuid.UUID
+}
+
+func (e *cartError) Error() string {
+	ids := make([]string, len(e.MedicineIDs))
+	for i, id := range e.MedicineIDs {
+		ids[i] = id.String()
+	}
+	return fmt.Sprintf("%s: %s", e.message, strings.Join(ids, ", "))
+}
+
+// medicineCacheKey is the ristretto key a medicine row is cached under
+func medicineCacheKey(id uuid.UUID) string {
+	return fmt.Sprintf("medicine:%s", id.String())
+}
+
+// medicineGenerations counts the committed writes to every medicine. A reader notes the generation
+// before querying a row and only caches it when no write was committed in the meantime, so a row
+// read before a write can't be cached after the write dropped it.
+var medicineGenerations = struct {
+	sync.Mutex
+	counts map[uuid.UUID]uint64
+}{counts: make(map[uuid.UUID]uint64)}
+
+// medicineGeneration returns the current generation of every medicine
+func medicineGeneration(ids []uuid.UUID) map[uuid.UUID]uint64 {
+	medicineGenerations.Lock()
+	defer medicineGenerations.Unlock()
+	generations := make(map[uuid.UUID]uint64, len(ids))
+	for _, id := range ids {
+		generations[id] = medicineGenerations.counts[id]
+	}
+	return generations
+}
+
+// cacheMedicine caches the row unless a write to the medicine was committed since its generation was noted
+func cacheMedicine(cache *ristretto.Cache, m Medicine, generation uint64) {
+	medicineGenerations.Lock()
+	defer medicineGenerations.Unlock()
+	if medicineGenerations.counts[m.ID] == generation {
+		cache.SetWithTTL(medicineCacheKey(m.ID), m, 1, medicineCacheTTL)
+	}
+}
+
+// loadMedicines returns the medicine rows for the given IDs. Rows found in the cache are used as is,
+// the rest are queried in one go and cached with a TTL unless a write to them committed meanwhile.
+func loadMedicines(ctx context.Context, q querier, cache *ristretto.Cache, ids []uuid.UUID) (map[uuid.UUID]Medicine, error) {
+	medicines := make(map[uuid.UUID]Medicine, len(ids))
+	var missingMedicineIDs []uuid.UUID
+	for _, id := range ids {
+		if _, seen := medicines[id]; seen {
+			continue
+		}
+		if val, found := cache.Get(medicineCacheKey(id)); found {
+			medicines[id] = val.(Medicine)
+		} else {
+			missingMedicineIDs = append(missingMedicineIDs, id)
+		}
+	}
+
+	if len(missingMedicineIDs) == 0 {
+		return medicines, nil
+	}
+
+	generations := medicineGeneration(missingMedicineIDs)
+	rows, _ := q.Query(ctx, `SELECT id, name, category, price FROM medicine WHERE id = ANY($1::uuid[]) AND is_active`, missingMedicineIDs)
+	var m Medicine
+	_, err := pgx.ForEachRow(rows, []any{&m.ID, &m.Name, &m.Category, &m.Price}, func() error {
+		cacheMedicine(cache, m, generations[m.ID])
+		medicines[m.ID] = m
+		return nil
+	})
+	return medicines, err
+}
+
+// priceCart reprices every cart item from the medicine table and recomputes the subtotal from the
+// line totals.
+// The returned order carries the authoritative names, categories and prices with order_total set to
+// the subtotal, the client's figure is only kept in the pricing report.
+func priceCart(ctx context.Context, q querier, cache *ristretto.Cache, order OrderInput) (OrderInput, CartPricing, error) {
+	ids := make([]uuid.UUID, len(order.CartItems))
+	for i, item := range order.CartItems {
+		ids[i] = item.ID
+	}
+
+	medicines, err := loadMedicines(ctx, q, cache, ids)
+	if err != nil {
+		return order, CartPricing{}, err
+	}
+
+	var unknown, invalid []uuid.UUID
+	var subtotal float64
+	priced := make([]Medicine, len(order.CartItems))
+	for i, item := range order.CartItems {
+		medicine, found := medicines[item.ID]
+		if !found {
+			unknown = append(unknown, item.ID)
+			continue
+		}
+		switch {
+		case item.Quantity < 0:
+			invalid = append(invalid, item.ID)
+			continue
+		case item.Quantity == 0:
+			medicine.Quantity = 1
+		default:
+			medicine.Quantity = item.Quantity
+		}
+		priced[i] = medicine
+		subtotal += medicine.LineTotal()
+	}
+	if len(unknown) > 0 {
+		return order, CartPricing{}, &cartError{message: "unknown or discontinued medicines in cart", MedicineIDs: unknown}
+	}
+	if len(invalid) > 0 {
+		return order, CartPricing{}, &cartError{message: "quantity must be positive", MedicineIDs: invalid}
+	}
+
+	pricing := CartPricing{
+		ClientTotal:   order.OrderTotal,
+		Subtotal:      subtotal,
+		PriceMismatch: math.Abs(order.OrderTotal-subtotal) > priceTolerance,
+	}
+	order.CartItems = priced
+	order.OrderTotal = subtotal
+	return order, pricing, nil
+}
+
+// pricingError is the problem for a cart that could not be priced
+func pricingError(err error) error {
+	var invalidCart *cartError
+	if errors.As(err, &invalidCart) {
+		problem := newProblem(fiber.StatusBadRequest, codeInvalidCart, err.Error())
+		problem.MedicineIDs = invalidCart.MedicineIDs
+		return problem
+	}
+	fmt.Printf("Error pricing cart: %v\n", err)
+	return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to price cart")
+}
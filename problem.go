@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// problemContentType is the media type of RFC 7807 problem details
+const problemContentType = "application/problem+json"
+
+// Error codes of a Problem. They are part of the API, clients match on them. An invalid coupon is
+// reported with the code of the first rule it failed, see the reason codes in explain.go.
+const (
+	codeInvalidInput         = "INVALID_INPUT"
+	codeValidationFailed     = "VALIDATION_FAILED"
+	codeInvalidCart          = "INVALID_CART"
+	codePriceMismatch        = "PRICE_MISMATCH"
+	codeNotFound             = "NOT_FOUND"
+	codeCouponNotFound       = "COUPON_NOT_FOUND"
+	codeAlreadyExists        = "ALREADY_EXISTS"
+	codeNotStackable         = "COUPON_NOT_STACKABLE"
+	codeExclusiveCoupons     = "COUPONS_EXCLUSIVE"
+	codeCouponInUse          = "COUPON_IN_USE"
+	codeCategoryHasChildren  = "CATEGORY_HAS_CHILDREN"
+	codeAlreadyReserved      = "ALREADY_RESERVED"
+	codeNoActiveReservation  = "NO_ACTIVE_RESERVATION"
+	codeOrderUserMismatch    = "ORDER_USER_MISMATCH"
+	codeNoRedemption         = "NO_REDEMPTION"
+	codeAlreadyReversed      = "ALREADY_REVERSED"
+	codeIdempotencyKeyReused = "IDEMPOTENCY_KEY_REUSED"
+	codeRequestInProgress    = "REQUEST_IN_PROGRESS"
+	codeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	codeInternal             = "INTERNAL_ERROR"
+)
+
+// Problem is the RFC 7807 problem details body every error response is sent as.
+// Code is a stable machine-readable error code, the other extension members are only set
+// for the errors they belong to.
+type Problem struct {
+	Type     string `json:"type" example:"about:blank"`
+	Title    string `json:"title" example:"Bad Request"`
+	Status   int    `json:"status" example:"400"`
+	Code     string `json:"code" example:"COUPON_EXPIRED"`
+	Detail   string `json:"detail,omitempty" example:"Coupon expired or not applicable"`
+	Instance string `json:"instance,omitempty" example:"/coupon/validate"`
+
+	// ValidationErrors is the rule every invalid field failed, set for VALIDATION_FAILED and negative charges
+	ValidationErrors map[string]string `json:"validation_errors,omitempty"`
+
+	// Reasons are all the rules an invalid coupon failed
+	Reasons []CouponRejection `json:"reasons,omitempty"`
+
+	// MedicineIDs are the cart items that could not be priced, set for INVALID_CART
+	MedicineIDs []uuid.UUID `json:"medicine_ids,omitempty"`
+
+	// CouponCodes are the coupons the error is about, set for ALREADY_RESERVED
+	CouponCodes []string `json:"coupon_codes,omitempty"`
+
+	// Pricing is the repriced cart, set for PRICE_MISMATCH
+	Pricing *CartPricing `json:"pricing,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Code, p.Detail)
+}
+
+// newProblem builds a problem for the status with the error code and a human readable detail
+func newProblem(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  utils.StatusMessage(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+// rejectionProblem is the problem for a coupon, or stack of coupons, that failed the validate rules
+func rejectionProblem(e couponEvaluation) *Problem {
+	code := codeInvalidInput
+	if len(e.Rejections) > 0 {
+		code = e.Rejections[0].Code
+	}
+	problem := newProblem(fiber.StatusBadRequest, code, e.Message)
+	problem.Reasons = e.Rejections
+	return problem
+}
+
+// validationErrors maps every field that failed validation to the rule it failed
+func validationErrors(err error) map[string]string {
+	fields := make(map[string]string)
+	var invalid validator.ValidationErrors
+	if !errors.As(err, &invalid) {
+		fields["body"] = err.Error()
+		return fields
+	}
+	for _, field := range invalid {
+		fields[field.Field()] = fmt.Sprintf("failed on '%s' validation.", field.Tag())
+	}
+	return fields
+}
+
+// validationProblem is the problem for a request body that failed validation, with the rule every
+// invalid field failed
+func validationProblem(fields map[string]string) *Problem {
+	problem := newProblem(fiber.StatusBadRequest, codeValidationFailed, "The request failed validation")
+	problem.ValidationErrors = fields
+	return problem
+}
+
+// databaseProblem is the problem for a failed write. Constraint violations are caused by the request,
+// anything else is logged and reported as an internal error.
+func databaseProblem(err error) *Problem {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "23505": // unique_violation
+			return newProblem(fiber.StatusConflict, codeAlreadyExists, pgErr.Detail)
+		case "23503", "23514", "22P02": // foreign_key_violation, check_violation, invalid_text_representation
+			return newProblem(fiber.StatusBadRequest, codeInvalidInput, pgErr.Detail)
+		}
+	}
+	fmt.Printf("Error writing to the database: %v\n", err)
+	return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to save changes")
+}
+
+// codeForStatus is the error code of errors raised by Fiber itself, such as unknown routes
+func codeForStatus(status int) string {
+	switch {
+	case status == fiber.StatusNotFound:
+		return codeNotFound
+	case status == fiber.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case status >= fiber.StatusInternalServerError:
+		return codeInternal
+	default:
+		return codeInvalidInput
+	}
+}
+
+// problemHandler is the Fiber error handler. Every error a handler returns is sent as a Problem,
+// errors that are not a Problem or a *fiber.Error are logged and hidden behind INTERNAL_ERROR.
+func problemHandler(c *fiber.Ctx, err error) error {
+	var problem *Problem
+	var fiberErr *fiber.Error
+	switch {
+	case errors.As(err, &problem):
+	case errors.As(err, &fiberErr):
+		problem = newProblem(fiberErr.Code, codeForStatus(fiberErr.Code), fiberErr.Message)
+	default:
+		fmt.Printf("Error handling %s %s: %v\n", c.Method(), c.Path(), err)
+		problem = newProblem(fiber.StatusInternalServerError, codeInternal, "Internal server error")
+	}
+
+	response := *problem
+	if response.Instance == "" {
+		response.Instance = c.Path()
+	}
+	return c.Status(response.Status).JSON(response, problemContentType)
+}
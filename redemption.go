@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// amountTolerance absorbs the float rounding of discounts, a refund this close to the discount left reverses all of it
+const amountTolerance = 0.005
+
+// Redemption is an entry of the redemption ledger, one per committed reservation
+type Redemption struct {
+	RedemptionID     uuid.UUID  `json:"redemption_id"`
+	OrderID          string     `json:"order_id"`
+	UserID           uuid.UUID  `json:"user_id"`
+	CouponCode       string     `json:"coupon_code"`
+	CouponVersion    *int       `json:"coupon_version"`
+	ItemsDiscount    float64    `json:"items_discount"`
+	ChargesDiscount  float64    `json:"charges_discount"`
+	ReversedDiscount float64    `json:"reversed_discount"`
+	RedeemedAt       time.Time  `json:"redeemed_at"`
+	ReversedAt       *time.Time `json:"reversed_at"`
+}
+
+// Discount is what the redemption discounted the order by
+func (r Redemption) Discount() float64 {
+	return r.ItemsDiscount + r.ChargesDiscount
+}
+
+// Remaining is the discount that has not been reversed yet
+func (r Redemption) Remaining() float64 {
+	return max(r.Discount()-r.ReversedDiscount, 0)
+}
+
+// ReverseRedemptionRequest is used in /coupon/reverse. Without coupon_code every redemption of the
+// order is reversed, without amount the whole discount left is reversed.
+type ReverseRedemptionRequest struct {
+	OrderID    string  `json:"order_id" validate:"required,max=100"`
+	CouponCode string  `json:"coupon_code" validate:"required_with=Amount,max=100"`
+	Amount     float64 `json:"amount" validate:"gte=0"`
+	Reason     string  `json:"reason" validate:"max=255"`
+}
+
+// RedemptionReversal is what one call of /coupon/reverse gave back for a redemption
+type RedemptionReversal struct {
+	RedemptionID     uuid.UUID `json:"redemption_id"`
+	CouponCode       string    `json:"coupon_code"`
+	Discount         float64   `json:"discount"`
+	ReversedDiscount float64   `json:"reversed_discount"`
+	UsageRestored    bool      `json:"usage_restored"`
+}
+
+// redemptionColumns are the coupon_redemption columns in the order of the Redemption fields
+const redemptionColumns = `r.redemption_id, r.order_id, r.user_id, r.coupon_code, r.coupon_version,
+	r.items_discount, r.charges_discount, r.reversed_discount, r.redeemed_at, r.reversed_at`
+
+// recordRedemption adds the committed reservation to the redemption ledger
+func recordRedemption(ctx context.Context, q querier, reservationID uuid.UUID) error {
+	_, err := q.Exec(ctx, `INSERT INTO coupon_redemption
+		(redemption_id, order_id, user_id, coupon_code, coupon_version, items_discount, charges_discount, window_start)
+		SELECT reservation_id, order_id, user_id, coupon_code, coupon_version, items_discount, charges_discount, window_start
+		FROM coupon_reservation WHERE reservation_id = $1`, reservationID)
+	return err
+}
+
+// reverseRedemption gives the discount back to the coupon's budget. Once the whole discount is
+// reversed the user's usage slot and the coupon's redemption are given back too. The usage of a
+// time_based coupon is only given back while its window is still the user's current one.
+// A campaign code's template gets its share of the usage and budget back the same way.
+func reverseRedemption(ctx context.Context, tx pgx.Tx, redemption Redemption, discount float64, reason string) (RedemptionReversal, error) {
+	reversal := RedemptionReversal{
+		RedemptionID:     redemption.RedemptionID,
+		CouponCode:       redemption.CouponCode,
+		Discount:         discount,
+		ReversedDiscount: redemption.ReversedDiscount + discount,
+		UsageRestored:    discount >= redemption.Remaining()-amountTolerance,
+	}
+
+	templateCode, err := campaignTemplateCode(ctx, tx, redemption.CouponCode)
+	if err != nil {
+		return reversal, err
+	}
+	codes := []string{redemption.CouponCode}
+	if templateCode != "" {
+		codes = append(codes, templateCode)
+	}
+
+	redemptions := 0
+	if reversal.UsageRestored {
+		redemptions = 1
+		if _, err := tx.Exec(ctx, `UPDATE coupon_usage SET usage = GREATEST(usage - 1, 0)
+			WHERE user_id = $1 AND coupon_code = ANY($2)
+			AND window_start IS NOT DISTINCT FROM (SELECT window_start FROM coupon_redemption WHERE redemption_id = $3)`,
+			redemption.UserID, codes, redemption.RedemptionID); err != nil {
+			return reversal, err
+		}
+	}
+	if _, err := tx.Exec(ctx, `UPDATE coupon SET budget_used = GREATEST(budget_used - $2, 0),
+		total_redemptions = GREATEST(total_redemptions - $3, 0)
+		WHERE coupon_code = ANY($1)`, codes, discount, redemptions); err != nil {
+		return reversal, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE coupon_redemption SET reversed_discount = $2,
+		reversed_at = CASE WHEN $3 THEN now() END
+		WHERE redemption_id = $1`, redemption.RedemptionID, reversal.ReversedDiscount, reversal.UsageRestored); err != nil {
+		return reversal, err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO coupon_redemption_reversal (redemption_id, discount, full_reversal, reason)
+		VALUES ($1, $2, $3, NULLIF($4, ''))`, redemption.RedemptionID, discount, reversal.UsageRestored, reason)
+	return reversal, err
+}
+
+// cancelOrder marks the order cancelled in the user_order ledger. It reports false when the order
+// isn't recorded or is already cancelled.
+func cancelOrder(ctx context.Context, q querier, orderID string) (bool, error) {
+	tag, err := q.Exec(ctx, `UPDATE user_order SET cancelled_at = now()
+		WHERE order_id = $1 AND cancelled_at IS NULL`, orderID)
+	return tag.RowsAffected() > 0, err
+}
+
+// cancelOrderHandler cancels an order with no redemption left to reverse
+func cancelOrderHandler(c *fiber.Ctx, tx pgx.Tx, orderID string) error {
+	ctx := c.Context()
+	cancelled, err := cancelOrder(ctx, tx, orderID)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to cancel order")
+	}
+	if !cancelled {
+		var recorded bool
+		if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM user_order WHERE order_id = $1)`, orderID).Scan(&recorded); err != nil {
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch order")
+		}
+		if !recorded {
+			return newProblem(fiber.StatusNotFound, codeNoRedemption, "No redemption or order recorded for this order")
+		}
+		return newProblem(fiber.StatusConflict, codeAlreadyReversed, "The order is already cancelled")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
+	}
+	return c.JSON(fiber.Map{
+		"order_id":        orderID,
+		"reversals":       []RedemptionReversal{},
+		"order_cancelled": true,
+	})
+}
+
+// ReverseRedemption godoc
+// @Summary Reverse the coupon redemptions of a cancelled or refunded order
+// @Description Gives the discount of the order's redemptions back to the coupons' budgets. A reversal of the whole discount left also gives back the user's usage slot and the coupon's redemption. amount reverses part of one coupon's discount for a partial refund. Without coupon_code the order is cancelled: every redemption is reversed in full and the order no longer counts for order-history conditions. An order placed without a coupon, or whose redemptions were all reversed already, is cancelled the same way, with no reversal
+// @Tags Coupons
+// @Accept json
+// @Produce json
+// @Param request body ReverseRedemptionRequest true "Order, optional coupon and amount"
+// @Param Idempotency-Key header string false "Retries with the same key replay the first response"
+// @Success 200 {object} map[string]interface{} "Reversals"
+// @Failure 400 {object} Problem "Validation errors or amount above the discount left"
+// @Failure 404 {object} Problem "No redemption for the order, nor an order recorded when coupon_code is left out"
+// @Failure 409 {object} Problem "Redemption already reversed or order already cancelled"
+// @Router /coupon/reverse [post]
+func reverseRedemptionHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	var req ReverseRedemptionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationProblem(validationErrors(err))
+	}
+
+	ctx := c.Context()
+	tx, err := connPool.Begin(ctx)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	// The redemptions are locked in coupon code order, as commit locks them, so concurrent reversals
+	// of the same order can't both give the same discount back
+	rows, _ := tx.Query(ctx, `SELECT `+redemptionColumns+` FROM coupon_redemption r
+		WHERE r.order_id = $1 AND ($2 = '' OR r.coupon_code = $2)
+		ORDER BY r.coupon_code
+		FOR UPDATE`, req.OrderID, req.CouponCode)
+	redemptions, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Redemption])
+	if err != nil {
+		fmt.Printf("Error fetching redemptions: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch redemptions")
+	}
+	if len(redemptions) == 0 {
+		// An order placed without a coupon has nothing to reverse, cancelling it only takes it
+		// out of the order history
+		if req.CouponCode == "" {
+			return cancelOrderHandler(c, tx, req.OrderID)
+		}
+		return newProblem(fiber.StatusNotFound, codeNoRedemption, "No redemption for this order")
+	}
+
+	var open []Redemption
+	for _, redemption := range redemptions {
+		if redemption.ReversedAt == nil {
+			open = append(open, redemption)
+		}
+	}
+	if len(open) == 0 {
+		// An order refunded in full before it is cancelled still has to leave the order history
+		if req.CouponCode == "" {
+			return cancelOrderHandler(c, tx, req.OrderID)
+		}
+		return newProblem(fiber.StatusConflict, codeAlreadyReversed, "The redemptions of this order are already reversed")
+	}
+	if req.Amount > open[0].Remaining()+amountTolerance {
+		return validationProblem(map[string]string{
+			"Amount": fmt.Sprintf("amount can't be more than the discount left to reverse, ₹%.2f.", open[0].Remaining()),
+		})
+	}
+
+	reversals := make([]RedemptionReversal, 0, len(open))
+	for _, redemption := range open {
+		discount := redemption.Remaining()
+		if req.Amount > 0 {
+			discount = math.Min(req.Amount, discount)
+		}
+		reversal, err := reverseRedemption(ctx, tx, redemption, discount, req.Reason)
+		if err != nil {
+			fmt.Printf("Error reversing redemption: %v\n", err)
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to reverse redemption")
+		}
+		reversals = append(reversals, reversal)
+	}
+
+	// A cancelled order no longer counts for the order-history conditions of the user's next orders
+	cancelled := req.CouponCode == ""
+	if cancelled {
+		if _, err := cancelOrder(ctx, tx, req.OrderID); err != nil {
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to cancel order")
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
+	}
+	return c.JSON(fiber.Map{
+		"order_id":        req.OrderID,
+		"reversals":       reversals,
+		"order_cancelled": cancelled,
+	})
+}
+
+// ListRedemptions godoc
+// @Summary List the redemption ledger
+// @Description Pages through the redemptions, newest first, with the discount given and how much of it was reversed
+// @Tags Admin
+// @Produce json
+// @Param coupon_code query string false "Redemptions of this coupon"
+// @Param order_id query string false "Redemptions of this order"
+// @Param user_id query string false "Redemptions of this user"
+// @Param page query int false "Page number, from 1" default(1)
+// @Param page_size query int false "Redemptions per page, at most 100" default(20)
+// @Success 200 {object} map[string]interface{} "Redemptions with the total count"
+// @Failure 400 {object} Problem "Invalid filter"
+// @Security ApiKeyAuth
+// @Router /admin/redemptions [get]
+func listRedemptionsHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	page := c.QueryInt("page", 1)
+	pageSize := c.QueryInt("page_size", defaultPageSize)
+	if page < 1 || pageSize < 1 || pageSize > maxPageSize {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput,
+			fmt.Sprintf("page must be at least 1 and page_size between 1 and %d", maxPageSize))
+	}
+
+	var conditions []string
+	var args []any
+	addCondition := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if couponCode := c.Query("coupon_code"); couponCode != "" {
+		addCondition(`r.coupon_code = $%d`, couponCode)
+	}
+	if orderID := c.Query("order_id"); orderID != "" {
+		addCondition(`r.order_id = $%d`, orderID)
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		id, err := uuid.Parse(userID)
+		if err != nil {
+			return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid user id")
+		}
+		addCondition(`r.user_id = $%d`, id)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	ctx := c.Context()
+	var total int
+	if err := connPool.QueryRow(ctx, `SELECT count(*) FROM coupon_redemption r `+where, args...).Scan(&total); err != nil {
+		fmt.Printf("Error counting redemptions: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to list redemptions")
+	}
+	args = append(args, pageSize, (page-1)*pageSize)
+	rows, _ := connPool.Query(ctx, fmt.Sprintf(`SELECT %s FROM coupon_redemption r
+		%s
+		ORDER BY r.redeemed_at DESC, r.redemption_id
+		LIMIT $%d OFFSET $%d`, redemptionColumns, where, len(args)-1, len(args)), args...)
+	redemptions, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Redemption])
+	if err != nil {
+		fmt.Printf("Error listing redemptions: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to list redemptions")
+	}
+
+	return c.JSON(fiber.Map{
+		"redemptions": redemptions,
+		"page":        page,
+		"page_size":   pageSize,
+		"total":       total,
+	})
+}
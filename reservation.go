@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// defaultReservationTTL is how long a reserved usage slot is held when the request doesn't ask for a TTL
+const defaultReservationTTL = 15 * time.Minute
+
+// maxReservationTTL caps the TTL a client can ask for so abandoned carts can't hold slots for days
+const maxReservationTTL = 24 * time.Hour
+
+// ReserveCouponRequest is used in /coupon/reserve. coupon_codes reserves a stack of coupons for the
+// order, otherwise coupon_code is reserved on its own.
+type ReserveCouponRequest struct {
+	OrderID     string   `json:"order_id"`
+	TTLSeconds  int      `json:"ttl_seconds"`
+	CouponCodes []string `json:"coupon_codes"`
+	ValidateCoupon
+}
+
+// ReservationActionRequest identifies the order in /coupon/commit and /coupon/release
+type ReservationActionRequest struct {
+	OrderID string `json:"order_id"`
+}
+
+// ReserveCoupon godoc
+// @Summary Reserve coupons for an order
+// @Description Validates the coupon, or the stack of coupons, and holds one of the user's usage slots per coupon for the order until the TTL lapses
+// @Tags Coupons
+// @Accept json
+// @Produce json
+// @Param request body ReserveCouponRequest true "Reservation request"
+// @Param Idempotency-Key header string false "Retries with the same key replay the first response"
+// @Success 200 {object} map[string]interface{} "Reservation details"
+// @Failure 400 {object} Problem "Coupon not applicable"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Failure 409 {object} Problem "Order already holds coupons, belongs to another user or order_total does not match the current prices"
+// @Router /coupon/reserve [post]
+func reserveCouponHandler(c *fiber.Ctx, connPool *pgxpool.Pool, cache *ristretto.Cache) error {
+	var req ReserveCouponRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	codes := uniqueCouponCodes(append(req.CouponCodes, req.CouponCode))
+	if req.OrderID == "" || req.UserID == uuid.Nil || len(codes) == 0 {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "order_id, user_id and a coupon code are required")
+	}
+	if err := validateCharges(req.Charges); err != nil {
+		return err
+	}
+
+	ttl := defaultReservationTTL
+	if req.TTLSeconds > 0 {
+		ttl = min(time.Duration(req.TTLSeconds)*time.Second, maxReservationTTL)
+	}
+
+	// The hold consumes real usage and budget, so the coupon is checked at the server's time.
+	// Only the read-only previews accept a client timestamp.
+	req.Timestamp = time.Now()
+
+	ctx := c.Context()
+
+	// The hold records the discount the order will be charged with, so a cart whose total
+	// disagrees with the catalogue is rejected rather than flagged
+	var pricing CartPricing
+	var err error
+	req.OrderInput, pricing, err = priceCart(ctx, connPool, cache, req.OrderInput)
+	if err != nil {
+		return pricingError(err)
+	}
+	if pricing.PriceMismatch {
+		problem := newProblem(fiber.StatusConflict, codePriceMismatch, "order_total does not match the current prices")
+		problem.Pricing = &pricing
+		return problem
+	}
+
+	tx, err := connPool.Begin(ctx)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	coupons, err := loadCouponStack(ctx, tx, codes)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeCouponNotFound, "Coupon not found")
+	}
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon")
+	}
+
+	// The user's usage rows are locked so concurrent reservations for the same user and coupon
+	// are serialised and can't both take the last slot, coupons with a global limit are locked
+	// the same way. Rows are locked in coupon code order so two stacks sharing coupons can't deadlock.
+	// The template of a campaign code is locked with it, its limits are shared by all of its codes.
+	lockOrder := append([]string(nil), codes...)
+	for _, coupon := range coupons {
+		if coupon.templateCode != "" && !slices.Contains(lockOrder, coupon.templateCode) {
+			lockOrder = append(lockOrder, coupon.templateCode)
+		}
+	}
+	sort.Strings(lockOrder)
+	for _, code := range lockOrder {
+		_, err = tx.Exec(ctx, `INSERT INTO coupon_usage (user_id, coupon_code, usage) VALUES ($1, $2, 0)
+			ON CONFLICT (user_id, coupon_code) DO NOTHING`, req.UserID, code)
+		if err == nil {
+			_, err = tx.Exec(ctx, `SELECT 1 FROM coupon_usage WHERE user_id = $1 AND coupon_code = $2 FOR UPDATE`, req.UserID, code)
+		}
+		if err != nil {
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to lock usage")
+		}
+	}
+
+	if err := lockCouponBudgets(ctx, tx, lockOrder); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to lock coupon")
+	}
+
+	// An order's stack is reserved in one call. Commit redeems every hold of the order with the discount
+	// it was reserved with, so a coupon added by a later call would skip the stacking rules and be
+	// discounted on the whole cart rather than on what the held coupons left.
+	var held []string
+	rows, _ := tx.Query(ctx, `SELECT coupon_code FROM coupon_reservation
+		WHERE order_id = $1 AND (status = 'committed' OR (status = 'reserved' AND expires_at > now()))
+		ORDER BY coupon_code`,
+		req.OrderID)
+	held, err = pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to check reservations")
+	}
+	if len(held) > 0 {
+		problem := newProblem(fiber.StatusConflict, codeAlreadyReserved,
+			"Order already holds coupons, release them and reserve the whole stack in one call")
+		problem.CouponCodes = held
+		return problem
+	}
+
+	// An order belongs to one user, its other coupons can't be held or redeemed by someone else
+	var otherUser bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM coupon_reservation
+			WHERE order_id = $1 AND user_id <> $2 AND (status = 'committed' OR (status = 'reserved' AND expires_at > now())))
+		OR EXISTS (SELECT 1 FROM user_order WHERE order_id = $1 AND user_id <> $2)`,
+		req.OrderID, req.UserID).Scan(&otherUser)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to check reservations")
+	}
+	if otherUser {
+		return newProblem(fiber.StatusConflict, codeOrderUserMismatch, "Order belongs to another user")
+	}
+
+	stack, err := evaluateCouponStack(ctx, tx, coupons, req.UserID, req.OrderInput)
+	if err != nil {
+		fmt.Printf("Error evaluating coupon: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to evaluate coupon")
+	}
+	if !stack.IsValid {
+		return rejectionProblem(stack.couponEvaluation)
+	}
+
+	// A lapsed reservation for the same order is marked expired so the new hold doesn't collide with it
+	_, err = tx.Exec(ctx, `UPDATE coupon_reservation SET status = 'expired', updated_at = now()
+		WHERE order_id = $1 AND coupon_code = ANY($2) AND status = 'reserved'`, req.OrderID, codes)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to expire old reservation")
+	}
+
+	// A hold never outlives its coupon, so an order can't be committed with a coupon that expired
+	// while the slot was held
+	expiries := make(map[string]time.Time, len(coupons))
+	for _, coupon := range coupons {
+		expiries[coupon.CouponCode] = couponExpiry(coupon)
+	}
+
+	reservationIDs := make(map[string]uuid.UUID, len(stack.Contributions))
+	var expiresAt time.Time
+	for _, contribution := range stack.Contributions {
+		reservationID := uuid.New()
+		err = tx.QueryRow(ctx, `INSERT INTO coupon_reservation
+			(reservation_id, order_id, user_id, coupon_code, coupon_version, items_discount, charges_discount, window_start, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, LEAST(now() + make_interval(secs => $9), $10))
+			RETURNING expires_at`,
+			reservationID, req.OrderID, req.UserID, contribution.CouponCode, contribution.couponVersion,
+			contribution.ItemsDiscount, contribution.ChargesDiscount, contribution.windowStart, ttl.Seconds(),
+			expiries[contribution.CouponCode]).Scan(&expiresAt)
+		if err != nil {
+			fmt.Printf("Error inserting reservation: %v\n", err)
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to reserve coupon")
+		}
+		reservationIDs[contribution.CouponCode] = reservationID
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
+	}
+
+	return c.JSON(fiber.Map{
+		"reservation_ids": reservationIDs,
+		"order_id":        req.OrderID,
+		"expires_at":      expiresAt,
+		"discount": fiber.Map{
+			"items_discount":   stack.ItemsDiscount,
+			"charges_discount": stack.ChargesDiscount,
+		},
+		"contributions":              stack.Contributions,
+		"charges_after_discount":     stack.ChargesAfterDiscount,
+		"order_value_after_discount": stack.OrderValueAfterDiscount(req.OrderInput),
+	})
+}
+
+// redeemCoupon adds a committed redemption in the window to the user's usage and consumes one of the
+// coupon's global redemptions and the discount from its budget
+func redeemCoupon(ctx context.Context, tx pgx.Tx, userID uuid.UUID, couponCode string, window *time.Time, discount float64) error {
+	// The usage row was created when the coupon was reserved, unless the hold predates the coupon
+	// becoming the template of a campaign
+	if _, err := tx.Exec(ctx, `INSERT INTO coupon_usage (user_id, coupon_code, usage) VALUES ($1, $2, 0)
+		ON CONFLICT (user_id, coupon_code) DO NOTHING`, userID, couponCode); err != nil {
+		return err
+	}
+	var usage int
+	var windowStart *time.Time
+	err := tx.QueryRow(ctx, `SELECT usage, window_start FROM coupon_usage
+		WHERE user_id = $1 AND coupon_code = $2 FOR UPDATE`, userID, couponCode).Scan(&usage, &windowStart)
+	if err != nil {
+		return err
+	}
+	usage, windowStart = committedUsage(usage, windowStart, window)
+	if _, err := tx.Exec(ctx, `UPDATE coupon_usage SET usage = $3, window_start = $4
+		WHERE user_id = $1 AND coupon_code = $2`, userID, couponCode, usage, windowStart); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE coupon SET total_redemptions = total_redemptions + 1, budget_used = budget_used + $2
+		WHERE coupon_code = $1`, couponCode, discount)
+	return err
+}
+
+// CommitReservation godoc
+// @Summary Commit the coupon reservations of an order
+// @Description Redeems every active reservation held by the order, consuming the user's usage slots, and records the redemptions and the order in their ledgers. The redemption ids are the reservation ids
+// @Tags Coupons
+// @Accept json
+// @Produce json
+// @Param request body ReservationActionRequest true "Order"
+// @Param Idempotency-Key header string false "Retries with the same key replay the first response"
+// @Success 200 {object} map[string]interface{} "Committed coupons"
+// @Failure 400 {object} Problem "An order-history condition no longer holds, such as another order placed first"
+// @Failure 404 {object} Problem "No active reservation"
+// @Failure 409 {object} Problem "Order holds reservations of more than one user"
+// @Router /coupon/commit [post]
+func commitReservationHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	var req ReservationActionRequest
+	if err := c.BodyParser(&req); err != nil || req.OrderID == "" {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "order_id is required")
+	}
+
+	ctx := c.Context()
+	tx, err := connPool.Begin(ctx)
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to begin transaction")
+	}
+	defer tx.Rollback(ctx)
+
+	type reservation struct {
+		ReservationID uuid.UUID
+		UserID        uuid.UUID
+		CouponCode    string
+		Discount      float64
+		WindowStart   *time.Time
+		TemplateCode  string
+	}
+	rows, _ := tx.Query(ctx, `SELECT r.reservation_id, r.user_id, r.coupon_code, r.items_discount + r.charges_discount,
+		r.window_start, COALESCE(cc.template_code, '')
+		FROM coupon_reservation r
+		JOIN coupon k ON k.coupon_code = r.coupon_code
+		LEFT JOIN coupon_campaign cc ON cc.campaign_id = k.campaign_id
+		WHERE r.order_id = $1 AND r.status = 'reserved' AND r.expires_at > now()
+		ORDER BY r.coupon_code
+		FOR UPDATE OF r`, req.OrderID)
+	reservations, err := pgx.CollectRows(rows, pgx.RowToStructByPos[reservation])
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch reservations")
+	}
+	if len(reservations) == 0 {
+		return newProblem(fiber.StatusNotFound, codeNoActiveReservation, "No active reservation for this order")
+	}
+	userID := reservations[0].UserID
+	for _, r := range reservations {
+		if r.UserID != userID {
+			return newProblem(fiber.StatusConflict, codeOrderUserMismatch, "Order holds reservations of more than one user")
+		}
+	}
+
+	//The user's orders are locked until the order is recorded, and the order-history conditions checked
+	//again against the orders placed since the coupons were reserved, so two orders reserved side by
+	//side can't both be the user's first order
+	if err := lockUserOrders(ctx, tx, userID); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to lock orders")
+	}
+	var history *OrderHistory
+	for _, r := range reservations {
+		coupon, err := loadCoupon(ctx, tx, r.CouponCode)
+		if err != nil {
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon")
+		}
+		if coupon.OrderCondition == "" {
+			continue
+		}
+		if history == nil {
+			loaded, err := loadOrderHistory(ctx, tx, userID, req.OrderID)
+			if err != nil {
+				return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch order history")
+			}
+			history = &loaded
+		}
+		if rejection := checkOrderCondition(coupon, *history, time.Now()); rejection != nil {
+			evaluation := invalidEvaluation([]CouponRejection{*rejection})
+			evaluation.Message = fmt.Sprintf("%s: %s", coupon.CouponCode, evaluation.Message)
+			return rejectionProblem(evaluation)
+		}
+	}
+
+	committed := make([]string, 0, len(reservations))
+	for _, r := range reservations {
+		//The user's usage, the coupon's global redemptions and its budget are consumed with the discount the slot was held for
+		if err := redeemCoupon(ctx, tx, r.UserID, r.CouponCode, r.WindowStart, r.Discount); err != nil {
+			fmt.Printf("Error redeeming coupon: %v\n", err)
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to update usage")
+		}
+		//A campaign code's redemption also counts on its template, whose limits span all of its codes
+		if r.TemplateCode != "" {
+			if err := redeemCoupon(ctx, tx, r.UserID, r.TemplateCode, nil, r.Discount); err != nil {
+				fmt.Printf("Error redeeming campaign template: %v\n", err)
+				return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to update usage")
+			}
+		}
+		if _, err := tx.Exec(ctx, `UPDATE coupon_reservation SET status = 'committed', updated_at = now()
+			WHERE reservation_id = $1`, r.ReservationID); err != nil {
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to commit reservation")
+		}
+		//The ledger keeps which order redeemed the coupon and for how much, so it can be reversed
+		if err := recordRedemption(ctx, tx, r.ReservationID); err != nil {
+			return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to record redemption")
+		}
+		committed = append(committed, r.CouponCode)
+	}
+
+	//The placed order goes into the ledger order-history conditions are checked against
+	if _, err := recordOrder(ctx, tx, req.OrderID, userID, time.Now()); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to record order")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Transaction commit failed")
+	}
+
+	return c.JSON(fiber.Map{
+		"order_id":          req.OrderID,
+		"committed_coupons": committed,
+		"message":           "Coupon redeemed successfully",
+	})
+}
+
+// ReleaseReservation godoc
+// @Summary Release the coupon reservations of an order
+// @Description Gives back the usage slots held by an order that was not placed
+// @Tags Coupons
+// @Accept json
+// @Produce json
+// @Param request body ReservationActionRequest true "Order"
+// @Param Idempotency-Key header string false "Retries with the same key replay the first response"
+// @Success 200 {object} map[string]interface{} "Released coupons"
+// @Failure 404 {object} Problem "No active reservation"
+// @Router /coupon/release [post]
+func releaseReservationHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	var req ReservationActionRequest
+	if err := c.BodyParser(&req); err != nil || req.OrderID == "" {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "order_id is required")
+	}
+
+	rows, _ := connPool.Query(c.Context(), `UPDATE coupon_reservation SET status = 'released', updated_at = now()
+		WHERE order_id = $1 AND status = 'reserved'
+		RETURNING coupon_code`, req.OrderID)
+	released, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to release reservation")
+	}
+	if len(released) == 0 {
+		return newProblem(fiber.StatusNotFound, codeNoActiveReservation, "No active reservation for this order")
+	}
+
+	return c.JSON(fiber.Map{
+		"order_id":         req.OrderID,
+		"released_coupons": released,
+	})
+}
+
+// sweepExpiredReservations periodically marks reservations whose TTL lapsed as expired.
+// Lapsed holds already stop counting towards usage, the sweep keeps their status honest.
+func sweepExpiredReservations(ctx context.Context, connPool *pgxpool.Pool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tag, err := connPool.Exec(ctx, `UPDATE coupon_reservation SET status = 'expired', updated_at = now()
+				WHERE status = 'reserved' AND expires_at <= now()`)
+			if err != nil {
+				log.Printf("reservation sweep failed: %v", err)
+				continue
+			}
+			if tag.RowsAffected() > 0 {
+				log.Printf("expired %d abandoned coupon reservations", tag.RowsAffected())
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// couponLocation is the timezone coupon schedules are evaluated in, set from COUPON_TIMEZONE on startup
+var couponLocation = time.UTC
+
+// minutesPerDay is the end_time of a schedule that runs until midnight
+const minutesPerDay = 24 * 60
+
+// CouponSchedule is a recurring window a time_based coupon can be used in, such as Sundays 18:00-22:00
+// or the first 3 days of each month. Empty day lists match every day. A window whose end_time is
+// before its start_time runs past midnight into the next day.
+type CouponSchedule struct {
+	DaysOfWeek  []int  `json:"days_of_week" validate:"dive,min=0,max=6"`
+	DaysOfMonth []int  `json:"days_of_month" validate:"dive,min=1,max=31"`
+	StartTime   string `json:"start_time" example:"18:00"`
+	EndTime     string `json:"end_time" example:"22:00"`
+}
+
+// parseClock turns "HH:MM" into minutes since midnight. "24:00" is accepted as the end of the day.
+func parseClock(clock string) (int, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(clock, "%d:%d", &hours, &minutes); err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	total := hours*60 + minutes
+	if hours < 0 || minutes < 0 || minutes > 59 || total > minutesPerDay {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	return total, nil
+}
+
+// formatClock turns minutes since midnight into "HH:MM"
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// minutes returns the schedule's window as minutes since midnight. An empty start_time is the
+// start of the day and an empty end_time the end of it.
+func (s CouponSchedule) minutes() (int, int, error) {
+	start, end := 0, minutesPerDay
+	var err error
+	if s.StartTime != "" {
+		if start, err = parseClock(s.StartTime); err != nil {
+			return 0, 0, err
+		}
+	}
+	if s.EndTime != "" {
+		if end, err = parseClock(s.EndTime); err != nil {
+			return 0, 0, err
+		}
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("start_time and end_time can't be the same")
+	}
+	return start, end, nil
+}
+
+// occurrence returns the start of the schedule's window the timestamp falls in, in couponLocation
+func (s CouponSchedule) occurrence(timestamp time.Time) (time.Time, bool) {
+	start, end, err := s.minutes()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	local := timestamp.In(couponLocation)
+	minute := local.Hour()*60 + local.Minute()
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, couponLocation)
+	switch {
+	case start < end && minute >= start && minute < end:
+	case start > end && minute >= start:
+	case start > end && minute < end:
+		// the window started the day before and runs past midnight
+		day = day.AddDate(0, 0, -1)
+	default:
+		return time.Time{}, false
+	}
+
+	if len(s.DaysOfWeek) > 0 && !slices.Contains(s.DaysOfWeek, int(day.Weekday())) {
+		return time.Time{}, false
+	}
+	if len(s.DaysOfMonth) > 0 && !slices.Contains(s.DaysOfMonth, day.Day()) {
+		return time.Time{}, false
+	}
+	return day.Add(time.Duration(start) * time.Minute), true
+}
+
+// scheduleOccurrence returns the start of the coupon's schedule window the timestamp falls in.
+// A coupon without schedules is in a window for as long as it is valid.
+func scheduleOccurrence(coupon CouponData, timestamp time.Time) (time.Time, bool) {
+	if len(coupon.Schedules) == 0 {
+		return coupon.ValidFrom, true
+	}
+	for _, schedule := range coupon.Schedules {
+		if start, ok := schedule.occurrence(timestamp); ok {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// checkValidity returns why the coupon can't be used at the timestamp, or nil when it can.
+// valid_from, valid_until and expiry_date always apply, the coupon's schedules narrow them down.
+func checkValidity(coupon CouponData, timestamp time.Time) *CouponRejection {
+	if timestamp.Before(coupon.ValidFrom) {
+		return &CouponRejection{Code: reasonNotYetValid, Message: "Coupon is not valid yet"}
+	}
+	if timestamp.After(coupon.ValidUntil) || timestamp.After(coupon.ExpiryDate) {
+		return &CouponRejection{Code: reasonExpired, Message: "Coupon expired or not applicable"}
+	}
+	if _, ok := scheduleOccurrence(coupon, timestamp); !ok {
+		return &CouponRejection{Code: reasonOutsideSchedule, Message: "Coupon is not valid at this time"}
+	}
+	return nil
+}
+
+// loadCouponSchedules reads the schedules of the given coupons, keyed by coupon code
+func loadCouponSchedules(ctx context.Context, q querier, codes []string) (map[string][]CouponSchedule, error) {
+	rows, _ := q.Query(ctx, `SELECT coupon_code, days_of_week, days_of_month, start_minute, end_minute
+		FROM coupon_schedule WHERE coupon_code = ANY($1) ORDER BY id`, codes)
+
+	schedules := make(map[string][]CouponSchedule)
+	var code string
+	var daysOfWeek, daysOfMonth []int
+	var startMinute, endMinute int
+	_, err := pgx.ForEachRow(rows, []any{&code, &daysOfWeek, &daysOfMonth, &startMinute, &endMinute}, func() error {
+		schedules[code] = append(schedules[code], CouponSchedule{
+			DaysOfWeek:  slices.Clone(daysOfWeek),
+			DaysOfMonth: slices.Clone(daysOfMonth),
+			StartTime:   formatClock(startMinute),
+			EndTime:     formatClock(endMinute),
+		})
+		return nil
+	})
+	return schedules, err
+}
+
+// insertCouponSchedules stores the coupon's schedules
+func insertCouponSchedules(ctx context.Context, q querier, couponCode string, schedules []CouponSchedule) error {
+	for _, schedule := range schedules {
+		start, end, err := schedule.minutes()
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec(ctx, `INSERT INTO coupon_schedule (coupon_code, days_of_week, days_of_month, start_minute, end_minute)
+			VALUES ($1, $2, $3, $4, $5)`,
+			couponCode, nonNilInts(schedule.DaysOfWeek), nonNilInts(schedule.DaysOfMonth), start, end)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nonNilInts keeps an omitted day list from being stored as NULL
+func nonNilInts(values []int) []int {
+	if values == nil {
+		return []int{}
+	}
+	return values
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ApplyCouponsRequest is used in /coupon/apply
+type ApplyCouponsRequest struct {
+	UserID      uuid.UUID `json:"user_id"`
+	CouponCodes []string  `json:"coupon_codes"`
+	OrderInput
+}
+
+// CouponContribution is what one coupon of a stack took off the order
+type CouponContribution struct {
+	// windowStart is the usage window a time_based coupon is redeemed in
+	windowStart *time.Time
+
+	// couponVersion is the version of the coupon the discount was calculated with
+	couponVersion int
+
+	Position        int            `json:"position"`
+	CouponCode      string         `json:"coupon_code"`
+	ItemsDiscount   float64        `json:"items_discount"`
+	ChargesDiscount float64        `json:"charges_discount"`
+	CapApplied      bool           `json:"cap_applied"`
+	Breakdown       []DiscountLine `json:"discount_breakdown"`
+}
+
+// stackEvaluation is the outcome of applying coupons one after the other. The embedded evaluation
+// holds the totals of the whole stack.
+type stackEvaluation struct {
+	couponEvaluation
+	Contributions []CouponContribution
+}
+
+// uniqueCouponCodes drops empty and repeated codes, keeping the first occurrence
+func uniqueCouponCodes(codes []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, code := range codes {
+		if code != "" && !seen[code] {
+			seen[code] = true
+			unique = append(unique, code)
+		}
+	}
+	return unique
+}
+
+// sortForStacking puts coupons in application order: highest priority first, then by coupon code
+// so the order is the same on every call
+func sortForStacking(coupons []CouponData) {
+	sort.Slice(coupons, func(i, j int) bool {
+		if coupons[i].Priority != coupons[j].Priority {
+			return coupons[i].Priority > coupons[j].Priority
+		}
+		return coupons[i].CouponCode < coupons[j].CouponCode
+	})
+}
+
+// checkStacking returns why the coupons can't be combined, or nil when they can.
+// A single coupon always stacks, otherwise every coupon must be stackable and at most one coupon
+// may come from each exclusivity group and each campaign.
+func checkStacking(coupons []CouponData) *CouponRejection {
+	if len(coupons) < 2 {
+		return nil
+	}
+	groups := make(map[string]string)
+	templates := make(map[string]string)
+	for _, coupon := range coupons {
+		if !coupon.Stackable {
+			return &CouponRejection{
+				Code:    codeNotStackable,
+				Message: fmt.Sprintf("Coupon %s can't be combined with other coupons", coupon.CouponCode),
+			}
+		}
+		if other, taken := templates[coupon.templateCode]; taken && coupon.templateCode != "" {
+			return &CouponRejection{
+				Code:    codeExclusiveCoupons,
+				Message: fmt.Sprintf("Coupons %s and %s are codes of the same campaign", other, coupon.CouponCode),
+			}
+		}
+		templates[coupon.templateCode] = coupon.CouponCode
+		if coupon.ExclusivityGroup == "" {
+			continue
+		}
+		if other, taken := groups[coupon.ExclusivityGroup]; taken {
+			return &CouponRejection{
+				Code:    codeExclusiveCoupons,
+				Message: fmt.Sprintf("Coupons %s and %s are exclusive to each other", other, coupon.CouponCode),
+			}
+		}
+		groups[coupon.ExclusivityGroup] = coupon.CouponCode
+	}
+	return nil
+}
+
+// loadCouponStack loads the coupons in application order. pgx.ErrNoRows is returned when one
+// of them does not exist.
+func loadCouponStack(ctx context.Context, q querier, codes []string) ([]CouponData, error) {
+	coupons := make([]CouponData, 0, len(codes))
+	for _, code := range codes {
+		coupon, err := loadCoupon(ctx, q, code)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, coupon)
+	}
+	sortForStacking(coupons)
+	return coupons, nil
+}
+
+// evaluateCouponStack applies the coupons in order, each on the amounts left by the ones before it.
+// The stack is invalid as soon as one coupon fails the validate rules.
+func evaluateCouponStack(ctx context.Context, q querier, coupons []CouponData, userID uuid.UUID, order OrderInput) (stackEvaluation, error) {
+	if rejection := checkStacking(coupons); rejection != nil {
+		return stackEvaluation{couponEvaluation: invalidEvaluation([]CouponRejection{*rejection})}, nil
+	}
+
+	stack := stackEvaluation{couponEvaluation: couponEvaluation{
+		IsValid:              true,
+		Message:              "Coupon applied succesfully",
+		ChargesAfterDiscount: order.Charges,
+	}}
+	remaining := order
+	for i, coupon := range coupons {
+		evaluation, err := evaluateCoupon(ctx, q, coupon, ValidateCoupon{
+			UserID:     userID,
+			CouponCode: coupon.CouponCode,
+			OrderInput: remaining,
+		})
+		if err != nil {
+			return stack, err
+		}
+		if !evaluation.IsValid {
+			evaluation.Message = fmt.Sprintf("%s: %s", coupon.CouponCode, evaluation.Message)
+			return stackEvaluation{couponEvaluation: evaluation}, nil
+		}
+
+		stack.ItemsDiscount += evaluation.ItemsDiscount
+		stack.ChargesDiscount += evaluation.ChargesDiscount
+		stack.ChargesAfterDiscount = evaluation.ChargesAfterDiscount
+		stack.Contributions = append(stack.Contributions, CouponContribution{
+			windowStart:     evaluation.WindowStart,
+			couponVersion:   coupon.version,
+			Position:        i + 1,
+			CouponCode:      coupon.CouponCode,
+			ItemsDiscount:   evaluation.ItemsDiscount,
+			ChargesDiscount: evaluation.ChargesDiscount,
+			CapApplied:      evaluation.CapApplied,
+			Breakdown:       evaluation.Breakdown,
+		})
+		remaining = evaluation.discountedOrder(remaining)
+	}
+	return stack, nil
+}
+
+// ApplyCoupons godoc
+// @Summary Apply several coupons to a cart
+// @Description Applies stackable coupons in priority order, each on the amount left by the ones before it, and returns every coupon's contribution. The user's usage is not consumed
+// @Tags Coupons
+// @Accept json
+// @Produce json
+// @Param request body ApplyCouponsRequest true "Coupons and cart"
+// @Success 200 {object} map[string]interface{} "Stacked discount"
+// @Failure 400 {object} Problem "Coupons can't be combined or are not applicable"
+// @Failure 404 {object} Problem "Coupon not found"
+// @Router /coupon/apply [post]
+func applyCouponsHandler(c *fiber.Ctx, connPool *pgxpool.Pool, cache *ristretto.Cache) error {
+	var req ApplyCouponsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid input")
+	}
+	codes := uniqueCouponCodes(req.CouponCodes)
+	if len(codes) == 0 {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "coupon_codes is required")
+	}
+	if err := validateCharges(req.Charges); err != nil {
+		return err
+	}
+
+	ctx := c.Context()
+	var pricing CartPricing
+	var err error
+	req.OrderInput, pricing, err = priceCart(ctx, connPool, cache, req.OrderInput)
+	if err != nil {
+		return pricingError(err)
+	}
+
+	coupons, err := loadCouponStack(ctx, connPool, codes)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return newProblem(fiber.StatusNotFound, codeCouponNotFound, "Coupon not found")
+	}
+	if err != nil {
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon")
+	}
+
+	stack, err := evaluateCouponStack(ctx, connPool, coupons, req.UserID, req.OrderInput)
+	if err != nil {
+		fmt.Printf("Error evaluating coupons: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to evaluate coupons")
+	}
+	if !stack.IsValid {
+		return rejectionProblem(stack.couponEvaluation)
+	}
+
+	return c.JSON(fiber.Map{
+		"is_valid": true,
+		"discount": fiber.Map{
+			"items_discount":   stack.ItemsDiscount,
+			"charges_discount": stack.ChargesDiscount,
+		},
+		"contributions":              stack.Contributions,
+		"charges_after_discount":     stack.ChargesAfterDiscount,
+		"order_value_after_discount": stack.OrderValueAfterDiscount(req.OrderInput),
+		"pricing":                    pricing,
+		"message":                    stack.Message,
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Usage types of a coupon. one_time coupons can be redeemed once across all users, multi_use coupons
+// follow max_usage_per_user and time_based coupons allow max_usage_per_user redemptions per window.
+const (
+	usageOneTime   = "one_time"
+	usageMultiUse  = "multi_use"
+	usageTimeBased = "time_based"
+)
+
+// usageWindowStart returns the start of the usage window the timestamp falls in for time_based
+// coupons, nil for the other usage types. Redemptions are placed in the window of the server's time. Every occurrence of a schedule is its own window, a
+// time_based coupon without schedules has a single window running from valid_from to valid_until.
+func usageWindowStart(coupon CouponData, timestamp time.Time) *time.Time {
+	if coupon.UsageType != usageTimeBased {
+		return nil
+	}
+	start, ok := scheduleOccurrence(coupon, timestamp)
+	if !ok {
+		return nil
+	}
+	return &start
+}
+
+// userUsageLimit is how many times a user can redeem the coupon, in every window for time_based
+// coupons. Zero means unlimited.
+func userUsageLimit(coupon CouponData) int {
+	if coupon.UsageType == usageOneTime {
+		return 1
+	}
+	return coupon.MaxUsagePerUser
+}
+
+// redemptionLimit is how many times the coupon can be redeemed across all users. one_time coupons
+// can only be redeemed once, whatever max_total_redemptions says. Zero means unlimited.
+func redemptionLimit(usageType string, maxTotalRedemptions int) int {
+	if usageType == usageOneTime {
+		return 1
+	}
+	return maxTotalRedemptions
+}
+
+// committedUsage returns the user's usage row once one more redemption in the window is committed.
+// The usage of a time_based coupon starts again from one when the redemption belongs to a later window.
+// The row only keeps the latest window, a redemption held over from an earlier one is left out rather
+// than moving the row back and resetting the usage of the current window.
+func committedUsage(usage int, current, window *time.Time) (int, *time.Time) {
+	switch {
+	case sameWindow(current, window):
+		return usage + 1, current
+	case current != nil && window != nil && window.Before(*current):
+		return usage, current
+	}
+	return 1, window
+}
+
+// sameWindow reports whether two usage windows are the same, nil being the window of the coupons
+// that are not time_based
+func sameWindow(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// userCouponUsage returns how many usage slots a user holds for a coupon: redemptions already
+// committed plus reservations that have not yet expired. For time_based coupons only the slots
+// of the given window count.
+func userCouponUsage(ctx context.Context, q querier, userID uuid.UUID, couponCode string, windowStart *time.Time) (int, error) {
+	var usage int
+	err := q.QueryRow(ctx, `SELECT
+		COALESCE((SELECT usage FROM coupon_usage
+			WHERE user_id = $1 AND coupon_code = $2 AND window_start IS NOT DISTINCT FROM $3), 0) +
+		(SELECT count(*) FROM coupon_reservation
+			WHERE user_id = $1 AND coupon_code = $2 AND status = 'reserved' AND expires_at > now()
+			AND window_start IS NOT DISTINCT FROM $3)
+	`, userID, couponCode, windowStart).Scan(&usage)
+	return usage, err
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedTimeLayout is how init.sql writes its timestamps
+const seedTimeLayout = "2006-01-02 15:04:05"
+
+var (
+	seedCouponRow = regexp.MustCompile(`(?m)^\('(\w+)',\s*'([^']+)',\s*'(\w+)',\s*([\d.]+),\s*'([^']+)',\s*'([^']+)',\s*'(\w+)',\s*([\d.]+),\s*'[^']*',\s*(\d+),\s*'(\w+)'\)`)
+	seedMaxTotal  = regexp.MustCompile(`UPDATE coupon SET max_total_redemptions = (\d+)[^;]*WHERE coupon_code = '(\w+)'`)
+	seedSchedule  = regexp.MustCompile(`(?m)^\('(\w+)',\s*'\{([\d,]*)\}',\s*'\{([\d,]*)\}',\s*(\d+),\s*(\d+)\)`)
+)
+
+// seedCoupons reads the coupons init.sql seeds, with their max_total_redemptions and schedules,
+// keyed by coupon code
+func seedCoupons(t *testing.T) map[string]CouponData {
+	t.Helper()
+	sql, err := os.ReadFile("init.sql")
+	if err != nil {
+		t.Fatalf("reading init.sql: %v", err)
+	}
+
+	seedTime := func(value string) time.Time {
+		parsed, err := time.Parse(seedTimeLayout, value)
+		if err != nil {
+			t.Fatalf("parsing seed timestamp %q: %v", value, err)
+		}
+		return parsed
+	}
+	seedNumber := func(value string) float64 {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("parsing seed number %q: %v", value, err)
+		}
+		return parsed
+	}
+	seedDays := func(value string) []int {
+		var days []int
+		for _, day := range strings.Split(value, ",") {
+			if day != "" {
+				days = append(days, int(seedNumber(day)))
+			}
+		}
+		return days
+	}
+
+	coupons := make(map[string]CouponData)
+	for _, row := range seedCouponRow.FindAllStringSubmatch(string(sql), -1) {
+		coupons[row[1]] = CouponData{
+			CouponCode:      row[1],
+			ExpiryDate:      seedTime(row[2]),
+			UsageType:       row[3],
+			MinOrderValue:   seedNumber(row[4]),
+			ValidFrom:       seedTime(row[5]),
+			ValidUntil:      seedTime(row[6]),
+			DiscountType:    row[7],
+			DiscountValue:   seedNumber(row[8]),
+			MaxUsagePerUser: int(seedNumber(row[9])),
+			DiscountTarget:  row[10],
+		}
+	}
+	if len(coupons) == 0 {
+		t.Fatal("no coupons found in init.sql")
+	}
+	for _, row := range seedMaxTotal.FindAllStringSubmatch(string(sql), -1) {
+		coupon := coupons[row[2]]
+		coupon.MaxTotalRedemptions = int(seedNumber(row[1]))
+		coupons[row[2]] = coupon
+	}
+	for _, row := range seedSchedule.FindAllStringSubmatch(string(sql), -1) {
+		coupon := coupons[row[1]]
+		coupon.Schedules = append(coupon.Schedules, CouponSchedule{
+			DaysOfWeek:  seedDays(row[2]),
+			DaysOfMonth: seedDays(row[3]),
+			StartTime:   formatClock(int(seedNumber(row[4]))),
+			EndTime:     formatClock(int(seedNumber(row[5]))),
+		})
+		coupons[row[1]] = coupon
+	}
+	return coupons
+}
+
+// seedCoupon returns the seed coupon with the code, failing the test when init.sql doesn't have it
+func seedCoupon(t *testing.T, coupons map[string]CouponData, code string) CouponData {
+	t.Helper()
+	coupon, found := coupons[code]
+	if !found {
+		t.Fatalf("coupon %s is not seeded by init.sql", code)
+	}
+	return coupon
+}
+
+func at(value string) time.Time {
+	parsed, err := time.Parse(seedTimeLayout, value)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func windowString(window *time.Time) string {
+	if window == nil {
+		return "none"
+	}
+	return window.Format(seedTimeLayout)
+}
+
+func TestUserUsageLimit(t *testing.T) {
+	coupons := seedCoupons(t)
+	tests := []struct {
+		code      string
+		usageType string
+		want      int
+	}{
+		{"SAVE10", usageOneTime, 1},
+		{"AMOX25", usageOneTime, 1},
+		{"SUMMER2024", usageMultiUse, 3},
+		{"SAVE5ALL", usageMultiUse, 10},
+		{"WELCOME50", usageMultiUse, 1},
+		{"NEWYEAR2025", usageTimeBased, 2},
+		{"LORA15", usageTimeBased, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			coupon := seedCoupon(t, coupons, tt.code)
+			if coupon.UsageType != tt.usageType {
+				t.Fatalf("usage_type = %s, want %s", coupon.UsageType, tt.usageType)
+			}
+			if got := userUsageLimit(coupon); got != tt.want {
+				t.Errorf("userUsageLimit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedemptionLimit(t *testing.T) {
+	coupons := seedCoupons(t)
+	tests := []struct {
+		code string
+		want int
+	}{
+		// one_time coupons are redeemed once across all users
+		{"SAVE10", 1},
+		{"FLAT20PAIN", 1},
+		// the welcome discount serves its first 1000 customers, once each
+		{"WELCOME50", 1000},
+		{"SUMMER2024", 0},
+		{"NEWYEAR2025", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			coupon := seedCoupon(t, coupons, tt.code)
+			if got := redemptionLimit(coupon.UsageType, coupon.MaxTotalRedemptions); got != tt.want {
+				t.Errorf("redemptionLimit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsageWindowStart(t *testing.T) {
+	location := couponLocation
+	couponLocation = time.UTC
+	defer func() { couponLocation = location }()
+
+	coupons := seedCoupons(t)
+	tests := []struct {
+		name      string
+		code      string
+		timestamp string
+		want      string
+	}{
+		{"multi_use has no window", "SUMMER2024", "2024-07-01 12:00:00", "none"},
+		{"one_time has no window", "SAVE10", "2025-06-01 12:00:00", "none"},
+		{"first day of the month", "NEWYEAR2025", "2025-01-01 09:00:00", "2025-01-01 00:00:00"},
+		{"third day of the month", "NEWYEAR2025", "2025-01-03 23:59:00", "2025-01-03 00:00:00"},
+		{"after the first 3 days", "NEWYEAR2025", "2025-01-05 10:00:00", "none"},
+		{"Sunday happy hour", "LORA15", "2025-06-01 19:30:00", "2025-06-01 18:00:00"},
+		{"Sunday before the happy hour", "LORA15", "2025-06-01 17:59:00", "none"},
+		{"Sunday after the happy hour", "LORA15", "2025-06-01 22:00:00", "none"},
+		{"Monday", "LORA15", "2025-06-02 19:30:00", "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coupon := seedCoupon(t, coupons, tt.code)
+			if got := windowString(usageWindowStart(coupon, at(tt.timestamp))); got != tt.want {
+				t.Errorf("usageWindowStart() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommittedUsage(t *testing.T) {
+	location := couponLocation
+	couponLocation = time.UTC
+	defer func() { couponLocation = location }()
+
+	coupons := seedCoupons(t)
+	tests := []struct {
+		name string
+		code string
+
+		// commits are the timestamps the reservations committed in order were made at
+		commits []string
+
+		// at is when the user tries the coupon again after the commits
+		at        string
+		wantUsage int
+		wantLimit bool
+	}{
+		{
+			name:      "one_time is used up by its only redemption",
+			code:      "SAVE10",
+			commits:   []string{"2025-06-01 12:00:00"},
+			at:        "2025-06-02 12:00:00",
+			wantUsage: 1,
+			wantLimit: true,
+		},
+		{
+			name:      "multi_use below max_usage_per_user",
+			code:      "SUMMER2024",
+			commits:   []string{"2024-07-01 12:00:00", "2024-08-01 12:00:00"},
+			at:        "2024-09-01 12:00:00",
+			wantUsage: 2,
+		},
+		{
+			name:      "multi_use at max_usage_per_user",
+			code:      "SUMMER2024",
+			commits:   []string{"2024-07-01 12:00:00", "2024-08-01 12:00:00", "2024-09-01 12:00:00"},
+			at:        "2024-10-01 12:00:00",
+			wantUsage: 3,
+			wantLimit: true,
+		},
+		{
+			name:      "time_based used up in its window",
+			code:      "NEWYEAR2025",
+			commits:   []string{"2025-01-01 09:00:00", "2025-01-01 18:00:00"},
+			at:        "2025-01-01 21:00:00",
+			wantUsage: 2,
+			wantLimit: true,
+		},
+		{
+			name:      "time_based starts again in the next window",
+			code:      "NEWYEAR2025",
+			commits:   []string{"2025-01-01 09:00:00", "2025-01-01 18:00:00", "2025-01-02 09:00:00"},
+			at:        "2025-01-02 21:00:00",
+			wantUsage: 1,
+		},
+		{
+			name:      "time_based hold from an earlier window doesn't reset the current one",
+			code:      "NEWYEAR2025",
+			commits:   []string{"2025-01-02 09:00:00", "2025-01-01 23:00:00", "2025-01-02 18:00:00"},
+			at:        "2025-01-02 21:00:00",
+			wantUsage: 2,
+			wantLimit: true,
+		},
+		{
+			name:      "time_based usage of last Sunday doesn't count",
+			code:      "LORA15",
+			commits:   []string{"2025-06-01 19:00:00"},
+			at:        "2025-06-08 19:00:00",
+			wantUsage: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coupon := seedCoupon(t, coupons, tt.code)
+
+			// the usage row starts empty, as reserve creates it
+			usage, window := 0, (*time.Time)(nil)
+			for _, commit := range tt.commits {
+				usage, window = committedUsage(usage, window, usageWindowStart(coupon, at(commit)))
+			}
+
+			// userCouponUsage only counts the row while its window is the current one
+			current := usageWindowStart(coupon, at(tt.at))
+			if !sameWindow(window, current) {
+				usage = 0
+			}
+			if usage != tt.wantUsage {
+				t.Errorf("usage = %d, want %d", usage, tt.wantUsage)
+			}
+			if limited := usage >= userUsageLimit(coupon); limited != tt.wantLimit {
+				t.Errorf("usage limit reached = %t, want %t", limited, tt.wantLimit)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Statuses of a coupon in the wallet
+const (
+	walletActive   = "active"
+	walletUpcoming = "upcoming"
+	walletUsed     = "used"
+	walletExpired  = "expired"
+	walletSoldOut  = "sold_out"
+)
+
+// WalletCoupon is a coupon as the user's wallet shows it
+type WalletCoupon struct {
+	CouponCode         string    `json:"coupon_code"`
+	Status             string    `json:"status"`
+	Personal           bool      `json:"personal"`
+	UsageType          string    `json:"usage_type"`
+	DiscountType       string    `json:"discount_type"`
+	DiscountValue      float64   `json:"discount_value"`
+	DiscountTarget     string    `json:"discount_target"`
+	MaxDiscountAmount  float64   `json:"max_discount_amount"`
+	MinOrderValue      float64   `json:"min_order_value"`
+	TermsAndConditions string    `json:"terms_and_conditions"`
+	ValidFrom          time.Time `json:"valid_from"`
+	ExpiresAt          time.Time `json:"expires_at"`
+	TimeLeftSeconds    int64     `json:"time_left_seconds"`
+	UsedCount          int       `json:"used_count"`
+	RemainingUses      *int      `json:"remaining_uses"`
+}
+
+// couponExpiry is when the coupon stops being valid, the earliest of valid_until and expiry_date
+func couponExpiry(coupon CouponData) time.Time {
+	if coupon.ExpiryDate.Before(coupon.ValidUntil) {
+		return coupon.ExpiryDate
+	}
+	return coupon.ValidUntil
+}
+
+// walletUsage is what a user has used of one coupon
+type walletUsage struct {
+	// redeemed counts the redemptions over all the windows of a time_based coupon
+	redeemed int
+
+	// windows are the slots held per usage window, redemptions plus active reservations
+	windows []windowSlots
+}
+
+// windowSlots are the slots a user holds in one usage window, nil for coupons without windows
+type windowSlots struct {
+	window *time.Time
+	slots  int
+}
+
+// slotsIn returns the slots the user holds in the window
+func (u walletUsage) slotsIn(window *time.Time) int {
+	// window_start is stored without a time zone and read back as UTC, the window is matched by its wall clock
+	if window != nil {
+		stored := time.Date(window.Year(), window.Month(), window.Day(), window.Hour(), window.Minute(),
+			window.Second(), window.Nanosecond(), time.UTC)
+		window = &stored
+	}
+	for _, w := range u.windows {
+		if sameWindow(w.window, window) {
+			return w.slots
+		}
+	}
+	return 0
+}
+
+// userWalletUsage reads the user's usage of every coupon in one query, keyed by coupon code.
+// Redemptions come from the redemption ledger, those reversed in full don't count. Reservations
+// still held count as used, as the validate rules count them.
+func userWalletUsage(ctx context.Context, q querier, userID uuid.UUID) (map[string]walletUsage, error) {
+	usages := make(map[string]walletUsage)
+	var code string
+	var window *time.Time
+	var redeemed, slots int
+	rows, _ := q.Query(ctx, `SELECT coupon_code, window_start, count(*) FILTER (WHERE redeemed)::int, count(*)::int
+		FROM (
+			SELECT coupon_code, window_start, true AS redeemed FROM coupon_redemption
+			WHERE user_id = $1 AND reversed_at IS NULL
+			UNION ALL
+			SELECT coupon_code, window_start, false FROM coupon_reservation
+			WHERE user_id = $1 AND status = 'reserved' AND expires_at > now()
+		) slots
+		GROUP BY coupon_code, window_start`, userID)
+	_, err := pgx.ForEachRow(rows, []any{&code, &window, &redeemed, &slots}, func() error {
+		usage := usages[code]
+		usage.redeemed += redeemed
+		usage.windows = append(usage.windows, windowSlots{window: window, slots: slots})
+		usages[code] = usage
+		return nil
+	})
+	return usages, err
+}
+
+// walletCoupon places the coupon in the wallet at the timestamp. The remaining uses follow the
+// validate rules: reservations still held count as used and time_based coupons count the current window.
+// A coupon whose redemption cap or budget is used up across all users is sold out.
+func walletCoupon(coupon CouponData, usage walletUsage, budget CouponBudget, timestamp time.Time) WalletCoupon {
+	expiresAt := couponExpiry(coupon)
+	entry := WalletCoupon{
+		CouponCode:         coupon.CouponCode,
+		Personal:           coupon.Personal,
+		UsageType:          coupon.UsageType,
+		DiscountType:       coupon.DiscountType,
+		DiscountValue:      coupon.DiscountValue,
+		DiscountTarget:     coupon.DiscountTarget,
+		MaxDiscountAmount:  coupon.MaxDiscountAmount,
+		MinOrderValue:      coupon.MinOrderValue,
+		TermsAndConditions: coupon.TermsAndConditions,
+		ValidFrom:          coupon.ValidFrom,
+		ExpiresAt:          expiresAt,
+		UsedCount:          usage.redeemed,
+	}
+	if expiresAt.After(timestamp) {
+		entry.TimeLeftSeconds = int64(expiresAt.Sub(timestamp).Seconds())
+	}
+
+	if limit := userUsageLimit(coupon); limit > 0 {
+		remaining := max(limit-usage.slotsIn(usageWindowStart(coupon, timestamp)), 0)
+		entry.RemainingUses = &remaining
+	}
+	redemptions, discount := budget.RemainingRedemptions(), budget.RemainingBudget()
+
+	switch {
+	case !expiresAt.After(timestamp):
+		entry.Status = walletExpired
+	case entry.RemainingUses != nil && *entry.RemainingUses == 0:
+		entry.Status = walletUsed
+	case (redemptions != nil && *redemptions == 0) || (discount != nil && *discount == 0):
+		entry.Status = walletSoldOut
+	case timestamp.Before(coupon.ValidFrom):
+		entry.Status = walletUpcoming
+	default:
+		entry.Status = walletActive
+	}
+	return entry
+}
+
+// CouponWallet godoc
+// @Summary Get a user's coupon wallet
+// @Description Lists the public coupons and the personal coupons assigned to the user, grouped into active, upcoming and used_or_expired, with the uses left and the time left before the coupon expires. Expired and sold out coupons are only listed when the user used them or they were assigned to the user
+// @Tags Coupons
+// @Produce json
+// @Param user_id path string true "User ID"
+// @Success 200 {object} map[string]interface{} "Wallet"
+// @Failure 400 {object} Problem "Invalid user id"
+// @Router /coupon/wallet/{user_id} [get]
+func couponWalletHandler(c *fiber.Ctx, connPool *pgxpool.Pool) error {
+	userID, err := uuid.Parse(c.Params("user_id"))
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, codeInvalidInput, "Invalid user id")
+	}
+
+	// Campaign codes are handed out outside the API, so only the coupons the user can see are listed
+	ctx := c.Context()
+	coupons, err := queryCoupons(ctx, connPool, `WHERE c.is_active AND NOT c.is_template AND c.campaign_id IS NULL
+		AND `+availableToUser(1)+`
+		ORDER BY c.coupon_code`, userID)
+	if err != nil {
+		fmt.Printf("Error listing wallet coupons: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupons")
+	}
+	// The usage and budgets of all the coupons are read up front rather than per coupon
+	usages, err := userWalletUsage(ctx, connPool, userID)
+	if err != nil {
+		fmt.Printf("Error fetching coupon usage: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon usage")
+	}
+	codes := make([]string, len(coupons))
+	for i, coupon := range coupons {
+		codes[i] = coupon.CouponCode
+	}
+	budgets, err := loadCouponBudgets(ctx, connPool, codes)
+	if err != nil {
+		fmt.Printf("Error fetching coupon budgets: %v\n", err)
+		return newProblem(fiber.StatusInternalServerError, codeInternal, "Failed to fetch coupon usage")
+	}
+
+	timestamp := time.Now()
+	active := []WalletCoupon{}
+	upcoming := []WalletCoupon{}
+	usedOrExpired := []WalletCoupon{}
+	for _, coupon := range coupons {
+		entry := walletCoupon(coupon, usages[coupon.CouponCode], budgets[coupon.CouponCode], timestamp)
+		switch entry.Status {
+		case walletActive:
+			active = append(active, entry)
+		case walletUpcoming:
+			upcoming = append(upcoming, entry)
+		case walletUsed:
+			usedOrExpired = append(usedOrExpired, entry)
+		case walletExpired, walletSoldOut:
+			// the public coupons that ran out before the user tried them are of no interest to them
+			if entry.UsedCount > 0 || entry.Personal {
+				usedOrExpired = append(usedOrExpired, entry)
+			}
+		}
+	}
+
+	// Active coupons expiring soonest come first, upcoming ones by when they start and the
+	// used or expired ones by when they expired, latest first
+	slices.SortStableFunc(active, func(a, b WalletCoupon) int { return a.ExpiresAt.Compare(b.ExpiresAt) })
+	slices.SortStableFunc(upcoming, func(a, b WalletCoupon) int { return a.ValidFrom.Compare(b.ValidFrom) })
+	slices.SortStableFunc(usedOrExpired, func(a, b WalletCoupon) int { return b.ExpiresAt.Compare(a.ExpiresAt) })
+
+	return c.JSON(fiber.Map{
+		"user_id":         userID,
+		"active":          active,
+		"upcoming":        upcoming,
+		"used_or_expired": usedOrExpired,
+	})
+}